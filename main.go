@@ -1,36 +1,396 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	gen "github.com/charles-m-knox/go-wgnetlib/pkg/wgnetlib"
 	"github.com/pterm/pterm"
-
-	"gopkg.in/yaml.v3"
+	"golang.org/x/term"
+	_ "modernc.org/sqlite"
 )
 
 var (
-	flagInteractive    bool
-	flagConfig         string
-	flagOutput         string
-	flagGzipProcessing bool
+	flagInteractive        bool
+	flagConfig             string
+	flagOutput             string
+	flagGzipProcessing     bool
+	flagFormat             string
+	flagCompression        string
+	flagDatabase           string
+	flagClientTemplate     string
+	flagServerTemplate     string
+	flagServerPeerTemplate string
+	flagRotateIDs          string
+	flagRotateName         string
+	flagRotateOlderThan    time.Duration
+	flagRotateLimit        uint
+	flagTransitional       string
+	flagGracePeriod        time.Duration
+	flagEncrypt            bool
+	flagKeyFile            string
+	flagPlan               string
+	flagSave               string
+)
+
+const (
+	formatYAML = "yaml"
+	formatDir  = "dir"
+
+	planText = "text"
+	planJSON = "json"
+
+	// envPassphrase is the environment variable that the passphrase for
+	// encrypted configurations is read from, instead of prompting for it.
+	envPassphrase = "WGNETLIB_PASSPHRASE"
 )
 
 func parseFlags() {
 	flag.BoolVar(&flagInteractive, "i", false, "interactive prompt/visual terminal output if set")
 	flag.BoolVar(&flagGzipProcessing, "gz", false, "(experimental) use gzip during processing of peers to shift ram usage at the cost of slowed processing")
-	flag.StringVar(&flagConfig, "f", "", "output (aka config) file to load, such as output.yml")
-	flag.StringVar(&flagOutput, "o", "", "file name to save to, such as output.yml")
+	flag.StringVar(&flagConfig, "f", "", "output (aka config) file to load, such as output.yml, output.json or output.toml")
+	flag.StringVar(&flagOutput, "o", "", "file name to save to, such as output.yml, output.json or output.toml, or directory name when using -format dir")
+	flag.StringVar(&flagFormat, "format", formatYAML, "output format: yaml writes the whole configuration to a single yaml, json or toml file depending on the extension of -o, dir writes each peer's config to its own file within a directory")
+	flag.StringVar(&flagDatabase, "db", "", "sqlite database to read existing peers from and write generated peers to, instead of -o; the generation params are loaded from it unless -f is specified")
+	flag.StringVar(&flagSave, "save", "", "file to save the configuration to when using -format dir, such as output.yml, so that the exported keys are kept for subsequent runs; defaults to -f")
+	flag.StringVar(&flagCompression, "compress", string(gen.CompressionNone), "compression for each file when using -format dir: none, gzip or xz")
+	flag.StringVar(&flagClientTemplate, "client-template", "", "text/template file used to render each client's config; saved in the generation params for subsequent runs")
+	flag.StringVar(&flagServerTemplate, "server-template", "", "text/template file used to render the [Interface] section of the server's config; saved in the generation params for subsequent runs")
+	flag.StringVar(&flagServerPeerTemplate, "server-peer-template", "", "text/template file used to render each [Peer] section of the server's config; saved in the generation params for subsequent runs")
+	flag.StringVar(&flagRotateIDs, "rotate-ids", "", "comma-separated ids of the peers whose keys to rotate instead of regenerating every peer's keys")
+	flag.StringVar(&flagRotateName, "rotate-name", "", "rotate the keys of the peers whose name matches this pattern, such as laptop-*")
+	flag.DurationVar(&flagRotateOlderThan, "rotate-older-than", 0, "rotate the keys of the peers whose keys were created longer ago than this, such as 2160h; keys in files saved before creation times were recorded count from when the file was first loaded")
+	flag.UintVar(&flagRotateLimit, "rotate-limit", 0, "rotate at most this many of the selected peers, lowest id first")
+	flag.StringVar(&flagTransitional, "transitional", "", "file to write a transitional server config to, in which peers rotated within -grace still use their previous keys")
+	flag.DurationVar(&flagGracePeriod, "grace", 24*time.Hour, "grace period for -transitional")
+	flag.BoolVar(&flagEncrypt, "encrypt", false, "encrypt the private keys, preshared keys and configs in the output with a passphrase, read from "+envPassphrase+" or prompted for")
+	flag.StringVar(&flagKeyFile, "key-file", "", "file containing a 32 byte key (raw or base64) to encrypt the output with, and to decrypt -f with")
+	flag.StringVar(&flagPlan, "plan", "", "print the changes that generating would make to the peers instead of writing any output: text or json")
 
 	flag.Parse()
 }
 
+// ptermProgress renders generation progress as a set of pterm progress bars,
+// one per generation phase.
+type ptermProgress struct {
+	multi *pterm.MultiPrinter
+	bars  map[gen.Phase]*pterm.ProgressbarPrinter
+	mutex sync.Mutex
+}
+
+func newPtermProgress() *ptermProgress {
+	multi := pterm.DefaultMultiPrinter
+	_, _ = multi.Start()
+
+	return &ptermProgress{
+		multi: &multi,
+		bars:  make(map[gen.Phase]*pterm.ProgressbarPrinter),
+	}
+}
+
+func (p *ptermProgress) bar(phase gen.Phase) *pterm.ProgressbarPrinter {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.bars[phase]
+}
+
+func (p *ptermProgress) Start(phase gen.Phase, total int) {
+	title := map[gen.Phase]string{
+		gen.PhasePreProcessing:  "Pre-processing IPs",
+		gen.PhaseConfiguring:    "Peers configured",
+		gen.PhasePostProcessing: "Peers post-processed",
+	}[phase]
+
+	bar, _ := pterm.DefaultProgressbar.WithWriter(p.multi.NewWriter()).WithTotal(total).Start(title)
+
+	p.mutex.Lock()
+	p.bars[phase] = bar
+	p.mutex.Unlock()
+}
+
+func (p *ptermProgress) Increment(phase gen.Phase) {
+	if bar := p.bar(phase); bar != nil {
+		bar.Increment()
+	}
+}
+
+func (p *ptermProgress) SetTotal(phase gen.Phase, total int) {
+	if bar := p.bar(phase); bar != nil {
+		bar.Total = total
+	}
+}
+
+func (p *ptermProgress) Done(phase gen.Phase) {
+	bar := p.bar(phase)
+	if bar == nil {
+		return
+	}
+
+	if bar.Current < bar.Total {
+		bar.Current = bar.Total - 1 // trick it into updating before stopping
+		bar.Increment()
+	}
+
+	_, _ = bar.Stop()
+}
+
+// Stop stops rendering all progress bars.
+func (p *ptermProgress) Stop() {
+	_, _ = p.multi.Stop()
+}
+
+// passphrase returns the passphrase for encrypted configurations from the
+// environment, or prompts for it if it isn't set.
+func passphrase() string {
+	if p := os.Getenv(envPassphrase); p != "" {
+		return p
+	}
+
+	// prompting only works when running in a terminal
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		log.Fatalf("a passphrase is required, set %v", envPassphrase)
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+
+	b, err := term.ReadPassword(fd)
+
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		log.Fatalf("failed to read passphrase: %v", err.Error())
+	}
+
+	p := string(b)
+	if p == "" {
+		log.Fatalf("a passphrase is required, set %v or enter one when prompted", envPassphrase)
+	}
+
+	return p
+}
+
+// parseRotation builds the key rotation from the -rotate-* flags. rotate is
+// false if none of them are set.
+func parseRotation() (rotation gen.KeyRotation, rotate bool, err error) {
+	for _, s := range strings.Split(flagRotateIDs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return rotation, false, fmt.Errorf("invalid peer id %v: %w", s, err)
+		}
+
+		rotation.IDs = append(rotation.IDs, uint(id))
+	}
+
+	rotation.NamePattern = flagRotateName
+	rotation.OlderThan = flagRotateOlderThan
+	rotation.Limit = flagRotateLimit
+
+	rotate = len(rotation.IDs) > 0 || rotation.NamePattern != "" || rotation.OlderThan > 0
+
+	return rotation, rotate, nil
+}
+
+// parseMapping parses the comma-separated old=new pairs of the -map flag of
+// the migrate subcommand.
+func parseMapping(s string) (map[string]string, error) {
+	mapping := map[string]string{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mapping %v, expected old=new", pair)
+		}
+
+		mapping[strings.TrimSpace(from)] = strings.TrimSpace(to)
+	}
+
+	return mapping, nil
+}
+
+// runMigrate implements the migrate subcommand, which renumbers an existing
+// configuration into a new CIDR while keeping every peer's keys.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+
+	config := flags.String("f", "", "config file to migrate, such as output.yml, output.json or output.toml")
+	output := flags.String("o", "", "file name to save the migrated config to, defaults to -f")
+	cidr := flags.String("cidr", "", "the new cidr")
+	strategy := flags.String("strategy", string(gen.MigrateOffset), "how addresses are mapped to the new cidr: offset keeps each peer's offset within the cidr, pack assigns the new addresses in order without gaps, manual uses -map and packs every other peer")
+	mapping := flags.String("map", "", "comma-separated old=new addresses for -strategy manual, where old is a peer's current address or uid, such as 10.0.0.5=10.1.0.53")
+	exclude := flags.String("exclude", "", "comma-separated excluded addresses within the new cidr, replacing those within the current cidr; if not set, those are moved to the same offset")
+	keyFile := flags.String("key-file", "", "file containing the 32 byte key that -f is encrypted with")
+
+	_ = flags.Parse(args)
+
+	if *config == "" || *cidr == "" {
+		log.Fatalf("migrate requires -f and -cidr")
+	}
+
+	if *output == "" {
+		*output = *config
+	}
+
+	migration := gen.CIDRMigration{CIDR: *cidr, Strategy: gen.MigrationStrategy(*strategy)}
+
+	var err error
+
+	migration.Mapping, err = parseMapping(*mapping)
+	if err != nil {
+		log.Fatalf("invalid -map: %v", err.Error())
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "exclude" {
+			return
+		}
+
+		migration.ExcludedAddresses = []string{}
+
+		for _, s := range strings.Split(*exclude, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				migration.ExcludedAddresses = append(migration.ExcludedAddresses, s)
+			}
+		}
+	})
+
+	conf := gen.Configuration{}
+	encryption := gen.EncryptionOptions{KeyFile: *keyFile}
+
+	err = conf.LoadWithOptions(*config, encryption)
+	if errors.Is(err, gen.ErrEncrypted) && *keyFile == "" {
+		// encrypted configurations stay encrypted when saved
+		encryption.Passphrase = passphrase()
+		err = conf.LoadWithOptions(*config, encryption)
+	}
+
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err.Error())
+	}
+
+	changes, err := conf.MigrateCIDR(migration)
+	if err != nil {
+		log.Fatalf("failed to migrate to %v: %v", *cidr, err.Error())
+	}
+
+	for _, c := range changes {
+		name := c.Name
+		if name == "" {
+			name = c.UID
+		}
+
+		fmt.Printf("peer %v (%v): %v -> %v\n", c.ID, name, c.From, c.To)
+	}
+
+	log.Printf("migrated to %v, %v peers changed address", *cidr, len(changes))
+
+	format, err := gen.FormatFromPath(*output)
+	if err != nil {
+		log.Fatalf("failed to determine output format: %v", err.Error())
+	}
+
+	b, err := conf.MarshalWithOptions(format, encryption)
+	if err != nil {
+		log.Fatalf("failed to marshal conf: %v", err.Error())
+	}
+
+	err = os.WriteFile(*output, b, 0o600)
+	if err != nil {
+		log.Fatalf("failed to write output to %v: %v", *output, err.Error())
+	}
+}
+
+// printPlan prints the changes that generating would make to the peers,
+// without writing anything.
+func printPlan(conf *gen.Configuration, opts gen.GenerateOptions) {
+	if flagPlan != planText && flagPlan != planJSON {
+		log.Fatalf("unsupported plan format: %v", flagPlan)
+	}
+
+	if flagRotateIDs != "" || flagRotateName != "" || flagRotateOlderThan > 0 || flagTransitional != "" {
+		log.Fatalf("-plan cannot be combined with key rotation")
+	}
+
+	plan, err := conf.PlanWithOptions(opts)
+	if err != nil {
+		log.Fatalf("failed to plan: %v", err.Error())
+	}
+
+	if flagPlan == planJSON {
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			log.Fatalf("failed to marshal plan: %v", err.Error())
+		}
+
+		fmt.Println(string(b))
+
+		return
+	}
+
+	peer := func(prefix string, p gen.PeerPlan) {
+		name := p.Name
+		if name == "" {
+			name = p.UID
+		}
+
+		fmt.Printf("%v peer %v (%v) %v\n", prefix, p.ID, name, p.IP)
+	}
+
+	for _, p := range plan.Added {
+		peer("+", p)
+	}
+
+	for _, p := range plan.Removed {
+		peer("-", p)
+	}
+
+	for _, p := range plan.Changed {
+		peer("~", p)
+
+		for _, f := range p.Fields {
+			fmt.Printf("    %v: %q -> %q\n", f.Field, f.From, f.To)
+		}
+	}
+
+	fmt.Printf(
+		"%v to add, %v to remove, %v to change, %v unchanged\n",
+		len(plan.Added),
+		len(plan.Removed),
+		len(plan.Changed),
+		plan.Unchanged,
+	)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+
+		return
+	}
+
 	parseFlags()
 
 	conf := gen.Configuration{
@@ -51,6 +411,17 @@ func main() {
 
 	var err error
 
+	// only the yaml, json & toml formats can hold encrypted secrets, so asking
+	// for encryption anywhere else would silently write them in plaintext
+	if (flagEncrypt || flagKeyFile != "") && (flagDatabase != "" || flagFormat != formatYAML) {
+		log.Fatalf("-encrypt and -key-file cannot be combined with -db or -format %v", formatDir)
+	}
+
+	encryption := gen.EncryptionOptions{KeyFile: flagKeyFile}
+	if flagEncrypt && flagKeyFile == "" {
+		encryption.Passphrase = passphrase()
+	}
+
 	if flagConfig != "" {
 		exists := true
 
@@ -58,21 +429,30 @@ func main() {
 			spinner, _ = pterm.DefaultSpinner.Start(fmt.Sprintf("loading from existing config file %v", flagConfig))
 		}
 
-		existing, err := os.ReadFile(flagConfig)
+		err = conf.LoadWithOptions(flagConfig, encryption)
+		if errors.Is(err, gen.ErrEncrypted) && flagKeyFile == "" && encryption.Passphrase == "" {
+			// encrypted configurations stay encrypted when saved
+			if flagDatabase != "" || flagFormat != formatYAML {
+				log.Fatalf("%v is encrypted, so it cannot be combined with -db or -format %v", flagConfig, formatDir)
+			}
+
+			if flagInteractive {
+				spinner.Stop()
+			}
+
+			encryption.Passphrase = passphrase()
+			err = conf.LoadWithOptions(flagConfig, encryption)
+		}
+
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
 				exists = false
 			} else {
-				log.Fatalf("failed to read from %v: %v", flagConfig, err.Error())
+				log.Fatalf("failed to load existing config: %v", err.Error())
 			}
 		}
 
 		if exists {
-			err = yaml.Unmarshal(existing, &conf)
-			if err != nil {
-				log.Fatalf("failed to unmarshal existing config: %v", err.Error())
-			}
-
 			if flagInteractive {
 				spinner.Stop()
 				spinner.Success()
@@ -88,16 +468,201 @@ func main() {
 
 	conf.UseGzipDuringProcessing = flagGzipProcessing
 
-	err = conf.Generate(flagInteractive)
+	templates := []struct {
+		path string
+		dest *string
+	}{
+		{flagClientTemplate, &conf.GenerationParams.ClientTemplate},
+		{flagServerTemplate, &conf.GenerationParams.ServerTemplate},
+		{flagServerPeerTemplate, &conf.GenerationParams.ServerPeerTemplate},
+	}
+
+	for _, t := range templates {
+		if t.path == "" {
+			continue
+		}
+
+		b, err := os.ReadFile(t.path)
+		if err != nil {
+			log.Fatalf("failed to read template %v: %v", t.path, err.Error())
+		}
+
+		*t.dest = string(b)
+	}
+
+	opts := gen.GenerateOptions{}
+
+	if flagDatabase != "" {
+		if flagOutput != "" || flagFormat != formatYAML {
+			log.Fatalf("-db cannot be combined with -o or -format")
+		}
+
+		db, err := sql.Open("sqlite", flagDatabase)
+		if err != nil {
+			log.Fatalf("failed to open database %v: %v", flagDatabase, err.Error())
+		}
+		defer db.Close()
+
+		store, err := gen.NewSQLiteStore(db)
+		if err != nil {
+			log.Fatalf("failed to initialize database %v: %v", flagDatabase, err.Error())
+		}
+
+		if flagConfig == "" {
+			form, ok, err := store.LoadForm()
+			if err != nil {
+				log.Fatalf("failed to load generation params from %v: %v", flagDatabase, err.Error())
+			}
+
+			if ok {
+				conf.GenerationParams = form
+			}
+		}
+
+		opts.Store = store
+	}
+
+	if flagPlan != "" {
+		printPlan(&conf, opts)
+
+		return
+	}
+
+	var exporter *gen.DirExporter
+
+	var serverWriter io.WriteCloser
+
+	// the configuration is written to this file once generating is done
+	save := flagOutput
+
+	// the peers exported with -format dir, which are saved to -save as well,
+	// without their configs
+	var exported []gen.WgConfig
+
+	switch flagFormat {
+	case formatYAML:
+	case formatDir:
+		// the exported configs only keep working if the keys they were
+		// generated with are used on the next run as well
+		save = flagSave
+		if save == "" {
+			save = flagConfig
+		}
+
+		if save == "" {
+			log.Fatalf("-format %v requires -save or -f to keep the generated keys", formatDir)
+		}
+
+		exporter, err = gen.NewDirExporter(flagOutput, gen.Compression(flagCompression))
+		if err != nil {
+			log.Fatalf("failed to create exporter: %v", err.Error())
+		}
+
+		serverWriter, err = exporter.ServerWriter()
+		if err != nil {
+			log.Fatalf("failed to create server config: %v", err.Error())
+		}
+
+		opts.Sink = gen.PeerSinkFunc(func(w gen.WgConfig) error {
+			err := exporter.Write(w)
+			if err != nil {
+				return err
+			}
+
+			// the config is already on disk, and keeping it would hold
+			// every rendered config in memory until generating is done
+			w.Config = ""
+			exported = append(exported, w)
+
+			return nil
+		})
+		opts.ServerWriter = serverWriter
+	default:
+		log.Fatalf("unsupported output format: %v", flagFormat)
+	}
+
+	var progress *ptermProgress
+
+	if flagInteractive {
+		progress = newPtermProgress()
+		opts.Progress = progress
+	}
+
+	rotation, rotate, err := parseRotation()
+	if err != nil {
+		log.Fatalf("invalid rotation: %v", err.Error())
+	}
+
+	if rotate || flagTransitional != "" {
+		if opts.Store != nil || opts.Sink != nil {
+			log.Fatalf("key rotation cannot be combined with -db or -format %v", formatDir)
+		}
+	}
+
+	if rotate {
+		var rotated []uint
+
+		rotated, err = conf.RotateKeysWithOptions(rotation, opts)
+		if err == nil {
+			log.Printf("rotated the keys of %v peers: %v", len(rotated), rotated)
+		}
+	} else {
+		err = conf.GenerateWithOptions(opts)
+	}
+
+	if progress != nil {
+		progress.Stop()
+	}
+
 	if err != nil {
 		log.Fatalf("failed to generate: %v", err.Error())
 	}
 
+	if exporter != nil {
+		err = serverWriter.Close()
+		if err != nil {
+			log.Fatalf("failed to write server config: %v", err.Error())
+		}
+
+		err = exporter.Close()
+		if err != nil {
+			log.Fatalf("failed to write manifest: %v", err.Error())
+		}
+
+		// the hubs & server are exported last
+		sort.Slice(exported, func(a, b int) bool {
+			return exported[a].ID < exported[b].ID
+		})
+
+		conf.Peers = exported
+	}
+
+	if opts.Store != nil {
+		return
+	}
+
+	if flagTransitional != "" {
+		transitional, err := conf.TransitionalServerConfig(flagGracePeriod)
+		if err != nil {
+			log.Fatalf("failed to generate transitional server config: %v", err.Error())
+		}
+
+		err = os.WriteFile(flagTransitional, []byte(transitional), 0o600)
+		if err != nil {
+			log.Fatalf("failed to write transitional server config to %v: %v", flagTransitional, err.Error())
+		}
+	}
+
 	if flagInteractive {
 		spinner, _ = pterm.DefaultSpinner.Start("marshaling config")
 	}
 
-	b, err := yaml.Marshal(conf)
+	format, err := gen.FormatFromPath(save)
+	if err != nil {
+		log.Fatalf("failed to determine output format: %v", err.Error())
+	}
+
+	b, err := conf.MarshalWithOptions(format, encryption)
 	if err != nil {
 		log.Fatalf("failed to marshal conf: %v", err.Error())
 	}
@@ -106,12 +671,12 @@ func main() {
 		spinner.Success()
 		spinner.Stop()
 
-		spinner, _ = pterm.DefaultSpinner.Start(fmt.Sprintf("writing %v bytes to %v", len(b), flagOutput))
+		spinner, _ = pterm.DefaultSpinner.Start(fmt.Sprintf("writing %v bytes to %v", len(b), save))
 	}
 
-	err = os.WriteFile(flagOutput, b, 0o644)
+	err = os.WriteFile(save, b, 0o600)
 	if err != nil {
-		log.Fatalf("failed to write output to %v: %v", flagOutput, err.Error())
+		log.Fatalf("failed to write output to %v: %v", save, err.Error())
 	}
 
 	if flagInteractive {
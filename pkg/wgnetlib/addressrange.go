@@ -0,0 +1,292 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddressRange is the set of addresses within a network that can be assigned
+// to peers. The network and broadcast addresses of IPv4 networks are not
+// usable, except in /31 networks, where both addresses are usable as a
+// point-to-point link (RFC 3021), and in /32 networks, which consist of a
+// single host. IPv6 networks have no broadcast address, so only the network
+// address (the subnet-router anycast address) is excluded, except in /127
+// (RFC 6164) and /128 networks. Additional addresses can be excluded with
+// Exclude.
+type AddressRange struct {
+	network *net.IPNet
+	// the first & last usable addresses, before exclusions
+	first net.IP
+	last  net.IP
+	// excluded addresses, in the order that they were excluded
+	excluded []addressSpan
+}
+
+// addressSpan is an inclusive span of addresses of the same family.
+type addressSpan struct {
+	// s is the span as it was configured, for error messages
+	s     string
+	first net.IP
+	last  net.IP
+}
+
+// within returns true if the whole span is within ipNet.
+func (span addressSpan) within(ipNet *net.IPNet) bool {
+	return ipNet.Contains(span.first) && ipNet.Contains(span.last)
+}
+
+// contains returns true if ip is within the span. ip must be normalized to
+// the same length as the span.
+func (span addressSpan) contains(ip net.IP) bool {
+	return bytes.Compare(ip, span.first) >= 0 && bytes.Compare(ip, span.last) <= 0
+}
+
+// normalizeIP returns ip in its 4 byte form if it's an IPv4 address, and in
+// its 16 byte form otherwise, so that addresses can be compared byte by byte.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip.To16()
+}
+
+// prevIP returns the address before ip.
+func prevIP(ip net.IP) net.IP {
+	newIP := make(net.IP, len(ip))
+	copy(newIP, ip)
+
+	for i := len(newIP) - 1; i >= 0; i-- {
+		newIP[i]--
+		if newIP[i] < 0xff {
+			break
+		}
+	}
+
+	return newIP
+}
+
+// parseAddressSpan parses a single address such as 10.0.0.5, a CIDR such as
+// 10.0.0.0/28, or an inclusive range such as 10.0.0.10-10.0.0.20.
+func parseAddressSpan(s string) (addressSpan, error) {
+	s = strings.TrimSpace(s)
+	span := addressSpan{s: s}
+
+	switch {
+	case strings.Contains(s, "/"):
+		_, ipNet, err := ParseAlignedCIDR(s)
+		if err != nil {
+			return span, err
+		}
+
+		span.first, span.last = normalizeIP(ipNet.IP), normalizeIP(LastIP(ipNet))
+	case strings.Contains(s, "-"):
+		from, to, _ := strings.Cut(s, "-")
+
+		first := net.ParseIP(strings.TrimSpace(from))
+		last := net.ParseIP(strings.TrimSpace(to))
+
+		if first == nil || last == nil {
+			return span, fmt.Errorf("invalid address range %v", s)
+		}
+
+		span.first, span.last = normalizeIP(first), normalizeIP(last)
+
+		if len(span.first) != len(span.last) || bytes.Compare(span.first, span.last) > 0 {
+			return span, fmt.Errorf("invalid address range %v, the first address must not be after the last one", s)
+		}
+	default:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return span, fmt.Errorf("invalid address %v", s)
+		}
+
+		span.first, span.last = normalizeIP(ip), normalizeIP(ip)
+	}
+
+	return span, nil
+}
+
+// NewAddressRange returns the usable addresses within ipNet.
+func NewAddressRange(ipNet *net.IPNet) *AddressRange {
+	ones, bits := ipNet.Mask.Size()
+
+	r := &AddressRange{
+		network: ipNet,
+		first:   normalizeIP(ipNet.IP),
+		last:    normalizeIP(LastIP(ipNet)),
+	}
+
+	// networks of one or two addresses have no network or broadcast address
+	if bits-ones <= 1 {
+		return r
+	}
+
+	r.first = NextIP(r.first)
+
+	if !IsIPv6(ipNet.IP) {
+		r.last = prevIP(r.last)
+	}
+
+	return r
+}
+
+// Network returns the network that the addresses belong to.
+func (r *AddressRange) Network() *net.IPNet {
+	return r.network
+}
+
+// NetworkAddress returns the network address, or nil if the network is too
+// small to have one.
+func (r *AddressRange) NetworkAddress() net.IP {
+	first := normalizeIP(r.network.IP)
+	if first.Equal(r.first) {
+		return nil
+	}
+
+	return first
+}
+
+// BroadcastAddress returns the broadcast address, or nil if the network has
+// none, such as IPv6 networks and IPv4 networks smaller than a /30.
+func (r *AddressRange) BroadcastAddress() net.IP {
+	last := normalizeIP(LastIP(r.network))
+	if last.Equal(r.last) {
+		return nil
+	}
+
+	return last
+}
+
+// Exclude prevents a single address such as 10.0.0.5, a CIDR such as
+// 10.0.0.0/28, or an inclusive range such as 10.0.0.10-10.0.0.20 from being
+// assigned to peers. The whole span must be within the network.
+func (r *AddressRange) Exclude(s string) error {
+	span, err := parseAddressSpan(s)
+	if err != nil {
+		return err
+	}
+
+	if !span.within(r.network) {
+		return fmt.Errorf("excluded addresses %v are not within %v", s, r.network)
+	}
+
+	r.excluded = append(r.excluded, span)
+
+	return nil
+}
+
+// exclusion returns the excluded span that contains ip, if any. ip must be
+// normalized.
+func (r *AddressRange) exclusion(ip net.IP) (addressSpan, bool) {
+	for _, span := range r.excluded {
+		if span.contains(ip) {
+			return span, true
+		}
+	}
+
+	return addressSpan{}, false
+}
+
+// IsUsable returns true if ip can be assigned to a peer.
+func (r *AddressRange) IsUsable(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	if len(ip) != len(r.first) {
+		return false
+	}
+
+	if bytes.Compare(ip, r.first) < 0 || bytes.Compare(ip, r.last) > 0 {
+		return false
+	}
+
+	_, excluded := r.exclusion(ip)
+
+	return !excluded
+}
+
+// Next returns the first usable address that is greater than or equal to ip
+// and not present in used, which is keyed by net.IP.String. Returns nil if
+// there are no more usable addresses.
+func (r *AddressRange) Next(ip net.IP, used map[string]bool) net.IP {
+	ip = normalizeIP(ip)
+	if len(ip) != len(r.first) || bytes.Compare(ip, r.last) > 0 {
+		return nil
+	}
+
+	if bytes.Compare(ip, r.first) < 0 {
+		ip = r.first
+	}
+
+	for {
+		span, excluded := r.exclusion(ip)
+
+		switch {
+		case excluded:
+			// skip over the whole span at once, since it may be huge
+			if bytes.Compare(span.last, r.last) >= 0 {
+				return nil
+			}
+
+			ip = NextIP(span.last)
+
+			continue
+		case !used[ip.String()]:
+			return ip
+		}
+
+		if ip.Equal(r.last) {
+			return nil
+		}
+
+		ip = NextIP(ip)
+	}
+}
+
+// First returns the first usable address, or nil if there is none.
+func (r *AddressRange) First() net.IP {
+	return r.Next(r.first, nil)
+}
+
+// After returns the first usable address after ip, or nil if there is none.
+func (r *AddressRange) After(ip net.IP) net.IP {
+	ip = normalizeIP(ip)
+	if ip == nil || ip.Equal(r.last) {
+		return nil
+	}
+
+	return r.Next(NextIP(ip), nil)
+}
+
+// parseExclusions parses the ExcludedAddresses of the GenerationForm.
+func (conf *Configuration) parseExclusions() ([]addressSpan, error) {
+	spans := make([]addressSpan, 0, len(conf.GenerationParams.ExcludedAddresses))
+
+	for _, s := range conf.GenerationParams.ExcludedAddresses {
+		span, err := parseAddressSpan(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded addresses: %w", err)
+		}
+
+		spans = append(spans, span)
+	}
+
+	return spans, nil
+}
+
+// excludeSpans excludes each of the spans that is within the range's network,
+// and returns the remaining spans.
+func (r *AddressRange) excludeSpans(spans []addressSpan) []addressSpan {
+	remaining := []addressSpan{}
+
+	for _, span := range spans {
+		if span.within(r.network) {
+			r.excluded = append(r.excluded, span)
+		} else {
+			remaining = append(remaining, span)
+		}
+	}
+
+	return remaining
+}
@@ -0,0 +1,301 @@
+package gen
+
+import (
+	"net"
+	"testing"
+)
+
+// ipString formats ip for comparisons, so that nil becomes "".
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+func TestAddressRange(t *testing.T) {
+	tests := []struct {
+		cidr      string
+		first     string
+		last      string
+		network   string
+		broadcast string
+		// count is the number of usable addresses, or 0 if the network is
+		// too large to count
+		count    int
+		usable   []string
+		unusable []string
+	}{
+		{
+			cidr:      "10.0.0.0/8",
+			first:     "10.0.0.1",
+			last:      "10.255.255.254",
+			network:   "10.0.0.0",
+			broadcast: "10.255.255.255",
+			usable:    []string{"10.0.0.255", "10.0.1.0", "10.128.0.0"},
+			unusable:  []string{"10.0.0.0", "10.255.255.255", "11.0.0.1"},
+		},
+		{
+			cidr:      "10.0.0.0/16",
+			first:     "10.0.0.1",
+			last:      "10.0.255.254",
+			network:   "10.0.0.0",
+			broadcast: "10.0.255.255",
+			count:     65534,
+			usable:    []string{"10.0.0.255", "10.0.1.0", "10.0.1.255", "10.0.255.0"},
+			unusable:  []string{"10.0.0.0", "10.0.255.255", "10.1.0.1"},
+		},
+		{
+			cidr:      "10.0.0.0/24",
+			first:     "10.0.0.1",
+			last:      "10.0.0.254",
+			network:   "10.0.0.0",
+			broadcast: "10.0.0.255",
+			count:     254,
+			usable:    []string{"10.0.0.1", "10.0.0.128", "10.0.0.254"},
+			unusable:  []string{"10.0.0.0", "10.0.0.255", "10.0.1.1"},
+		},
+		{
+			cidr:      "10.0.0.128/25",
+			first:     "10.0.0.129",
+			last:      "10.0.0.254",
+			network:   "10.0.0.128",
+			broadcast: "10.0.0.255",
+			count:     126,
+			usable:    []string{"10.0.0.129", "10.0.0.254"},
+			unusable:  []string{"10.0.0.127", "10.0.0.128", "10.0.0.255"},
+		},
+		{
+			cidr:      "10.0.0.4/30",
+			first:     "10.0.0.5",
+			last:      "10.0.0.6",
+			network:   "10.0.0.4",
+			broadcast: "10.0.0.7",
+			count:     2,
+			usable:    []string{"10.0.0.5", "10.0.0.6"},
+			unusable:  []string{"10.0.0.4", "10.0.0.7"},
+		},
+		{
+			// a point-to-point link, RFC 3021
+			cidr:     "10.0.0.4/31",
+			first:    "10.0.0.4",
+			last:     "10.0.0.5",
+			count:    2,
+			usable:   []string{"10.0.0.4", "10.0.0.5"},
+			unusable: []string{"10.0.0.3", "10.0.0.6"},
+		},
+		{
+			cidr:     "10.0.0.4/32",
+			first:    "10.0.0.4",
+			last:     "10.0.0.4",
+			count:    1,
+			usable:   []string{"10.0.0.4"},
+			unusable: []string{"10.0.0.3", "10.0.0.5"},
+		},
+		{
+			cidr:     "fd00::/64",
+			first:    "fd00::1",
+			last:     "fd00::ffff:ffff:ffff:ffff",
+			network:  "fd00::",
+			usable:   []string{"fd00::1", "fd00::ffff:ffff:ffff:ffff"},
+			unusable: []string{"fd00::", "fd00:0:0:1::1", "10.0.0.1"},
+		},
+		{
+			cidr:     "fd00::/126",
+			first:    "fd00::1",
+			last:     "fd00::3",
+			network:  "fd00::",
+			count:    3,
+			usable:   []string{"fd00::1", "fd00::3"},
+			unusable: []string{"fd00::", "fd00::4"},
+		},
+		{
+			// a point-to-point link, RFC 6164
+			cidr:     "fd00::/127",
+			first:    "fd00::",
+			last:     "fd00::1",
+			count:    2,
+			usable:   []string{"fd00::", "fd00::1"},
+			unusable: []string{"fd00::2"},
+		},
+		{
+			cidr:     "fd00::/128",
+			first:    "fd00::",
+			last:     "fd00::",
+			count:    1,
+			usable:   []string{"fd00::"},
+			unusable: []string{"fd00::1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			_, ipNet, err := ParseAlignedCIDR(tt.cidr)
+			if err != nil {
+				t.Fatalf("failed to parse cidr: %v", err)
+			}
+
+			r := NewAddressRange(ipNet)
+
+			if got := ipString(r.First()); got != tt.first {
+				t.Errorf("First() = %v, want %v", got, tt.first)
+			}
+
+			if got := ipString(r.last); got != tt.last {
+				t.Errorf("last = %v, want %v", got, tt.last)
+			}
+
+			if got := ipString(r.NetworkAddress()); got != tt.network {
+				t.Errorf("NetworkAddress() = %v, want %v", got, tt.network)
+			}
+
+			if got := ipString(r.BroadcastAddress()); got != tt.broadcast {
+				t.Errorf("BroadcastAddress() = %v, want %v", got, tt.broadcast)
+			}
+
+			for _, s := range tt.usable {
+				if !r.IsUsable(net.ParseIP(s)) {
+					t.Errorf("%v should be usable", s)
+				}
+			}
+
+			for _, s := range tt.unusable {
+				if r.IsUsable(net.ParseIP(s)) {
+					t.Errorf("%v should not be usable", s)
+				}
+			}
+
+			if tt.count == 0 {
+				return
+			}
+
+			count := 0
+			for ip := r.First(); ip != nil; ip = r.After(ip) {
+				count++
+			}
+
+			if count != tt.count {
+				t.Errorf("%v usable addresses, want %v", count, tt.count)
+			}
+		})
+	}
+}
+
+func TestAddressRangeExclude(t *testing.T) {
+	_, ipNet, _ := ParseAlignedCIDR("10.0.0.0/24")
+
+	r := NewAddressRange(ipNet)
+
+	for _, s := range []string{"10.0.0.1", "10.0.0.16/28", "10.0.0.100-10.0.0.120"} {
+		err := r.Exclude(s)
+		if err != nil {
+			t.Fatalf("failed to exclude %v: %v", s, err)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.1", "10.0.0.16", "10.0.0.31", "10.0.0.100", "10.0.0.120"} {
+		if r.IsUsable(net.ParseIP(s)) {
+			t.Errorf("%v should be excluded", s)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.2", "10.0.0.15", "10.0.0.32", "10.0.0.99", "10.0.0.121"} {
+		if !r.IsUsable(net.ParseIP(s)) {
+			t.Errorf("%v should be usable", s)
+		}
+	}
+
+	next := []struct {
+		from string
+		used []string
+		want string
+	}{
+		{from: "10.0.0.0", want: "10.0.0.2"},
+		{from: "10.0.0.16", want: "10.0.0.32"},
+		{from: "10.0.0.100", used: []string{"10.0.0.121"}, want: "10.0.0.122"},
+		{from: "10.0.0.254", used: []string{"10.0.0.254"}, want: ""},
+	}
+
+	for _, tt := range next {
+		used := make(map[string]bool)
+		for _, s := range tt.used {
+			used[s] = true
+		}
+
+		if got := ipString(r.Next(net.ParseIP(tt.from), used)); got != tt.want {
+			t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+
+	invalid := []string{
+		"10.0.1.0/28",            // not within the network
+		"10.0.0.5/24",            // not aligned
+		"10.0.0.20-10.0.0.10",    // reversed
+		"10.0.0.1-fd00::1",       // mixed families
+		"not an address",         // invalid
+		"10.0.0.250-10.0.1.5",    // partly outside the network
+		"fd00::1",                // another family
+		"10.0.0.300",             // invalid
+		"10.0.0.0/33",            // invalid
+		"10.0.0.10 - 10.0.0.5",   // reversed, with spaces
+		"10.0.0.10-not-an-ip",    // invalid
+		"10.0.0.10-",             // incomplete
+		"-10.0.0.10",             // incomplete
+		"10.0.0.0/16",            // larger than the network
+		"10.0.0.0-10.0.1.0",      // larger than the network
+		"fd00::/64",              // another family
+		"fd00::1-fd00::2",        // another family
+		"10.0.0.1-10.0.0.1-10.0", // invalid
+	}
+
+	for _, s := range invalid {
+		if err := r.Exclude(s); err == nil {
+			t.Errorf("excluding %v should fail", s)
+		}
+	}
+}
+
+func TestGenerateExcludedAddresses(t *testing.T) {
+	conf := Configuration{
+		GenerationParams: GenerationForm{
+			CIDR:              "10.0.0.0/28",
+			Server:            "10.0.0.1",
+			Endpoint:          "5.5.5.5",
+			EndpointPort:      51820,
+			ExcludedAddresses: []string{"10.0.0.2", "10.0.0.8/30", "10.0.0.12-10.0.0.13"},
+		},
+	}
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	got := []string{}
+	for _, w := range conf.Peers {
+		got = append(got, w.IP)
+	}
+
+	want := []string{"10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.14"}
+
+	if len(got) != len(want) {
+		t.Fatalf("peers have addresses %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("peers have addresses %v, want %v", got, want)
+		}
+	}
+
+	for _, excluded := range [][]string{{"10.0.1.0"}, {"10.0.0.1"}, {"nope"}} {
+		conf := Configuration{GenerationParams: conf.GenerationParams}
+		conf.GenerationParams.ExcludedAddresses = excluded
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err == nil {
+			t.Errorf("generating with excluded addresses %v should fail", excluded)
+		}
+	}
+}
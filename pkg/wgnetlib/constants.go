@@ -1,8 +1,12 @@
 package gen
 
 const (
-	DefaultAllowedIPs = "0.0.0.0/0"
+	DefaultAllowedIPs     = "0.0.0.0/0"
+	DefaultAllowedIPsIPv6 = "::/0"
 	// DefaultPersistentKeepAlive = uint(25)
 	// DefaultEndpointPort        = uint16(51820)
 	DefaultMTU = uint16(1280)
+	// DefaultMaxMeshSize is the largest mesh that can be generated if
+	// GenerationForm.MaxMeshSize isn't set.
+	DefaultMaxMeshSize = uint(256)
 )
@@ -0,0 +1,290 @@
+package gen
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFScrypt derives the encryption key from a passphrase using scrypt.
+	KDFScrypt = "scrypt"
+	// KDFKeyFile uses the contents of a key file as the encryption key.
+	KDFKeyFile = "keyfile"
+
+	// encryptedPrefix marks a value that has been encrypted.
+	encryptedPrefix = "enc:"
+	// encryptionCheck is encrypted into the header so that a wrong passphrase
+	// or key file can be detected before decrypting anything else.
+	encryptionCheck = "wgnetlib"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrEncrypted is returned when loading an encrypted configuration without a
+// passphrase or key file.
+var ErrEncrypted = errors.New("configuration is encrypted")
+
+// EncryptionOptions holds the secret used to encrypt the secret fields of a
+// configuration when saving, and to decrypt them when loading. At most one of
+// Passphrase and KeyFile may be set; if neither is set, nothing is encrypted.
+type EncryptionOptions struct {
+	// Passphrase derives the encryption key using scrypt.
+	Passphrase string
+	// KeyFile is the path to a file containing a 32 byte key, either as raw
+	// bytes or base64-encoded, such as one created with
+	// "head -c 32 /dev/urandom | base64".
+	KeyFile string
+}
+
+// enabled returns true if a passphrase or key file is set.
+func (opts EncryptionOptions) enabled() bool {
+	return opts.Passphrase != "" || opts.KeyFile != ""
+}
+
+// Encryption describes how the secret fields of a saved configuration are
+// encrypted. Every private key, preshared key and rendered config is encrypted
+// with XChaCha20-Poly1305, using a key that is either derived from a
+// passphrase or read from a key file.
+type Encryption struct {
+	// KDF is either KDFScrypt or KDFKeyFile.
+	KDF string `yaml:"kdf" json:"kdf" toml:"kdf"`
+	// Salt, N, R and P are the scrypt parameters, base64-encoded in the case
+	// of Salt.
+	Salt string `yaml:"salt,omitempty" json:"salt,omitempty" toml:"salt,omitempty"`
+	N    int    `yaml:"n,omitempty" json:"n,omitempty" toml:"n,omitempty"`
+	R    int    `yaml:"r,omitempty" json:"r,omitempty" toml:"r,omitempty"`
+	P    int    `yaml:"p,omitempty" json:"p,omitempty" toml:"p,omitempty"`
+	// Check is a known value encrypted with the key.
+	Check string `yaml:"check" json:"check" toml:"check"`
+}
+
+// readKeyFile reads a 32 byte key from path.
+func readKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %v: %w", path, err)
+	}
+
+	if len(b) == chacha20poly1305.KeySize {
+		return b, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("key file %v must contain a %v byte key, either raw or base64-encoded", path, chacha20poly1305.KeySize)
+	}
+
+	return key, nil
+}
+
+// deriveKey returns the key for the given header & options.
+func deriveKey(header Encryption, opts EncryptionOptions) ([]byte, error) {
+	switch header.KDF {
+	case KDFScrypt:
+		if opts.Passphrase == "" {
+			return nil, fmt.Errorf("%w with a passphrase, which is required to load it", ErrEncrypted)
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(header.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption salt: %w", err)
+		}
+
+		key, err := scrypt.Key([]byte(opts.Passphrase), salt, header.N, header.R, header.P, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive encryption key: %w", err)
+		}
+
+		return key, nil
+	case KDFKeyFile:
+		if opts.KeyFile == "" {
+			return nil, fmt.Errorf("%w with a key file, which is required to load it", ErrEncrypted)
+		}
+
+		return readKeyFile(opts.KeyFile)
+	default:
+		return nil, fmt.Errorf("unsupported encryption kdf: %v", header.KDF)
+	}
+}
+
+// newEncryption creates a new header and key from the options.
+func newEncryption(opts EncryptionOptions) (Encryption, []byte, error) {
+	if opts.Passphrase != "" && opts.KeyFile != "" {
+		return Encryption{}, nil, fmt.Errorf("a passphrase and a key file cannot both be used at the same time")
+	}
+
+	header := Encryption{KDF: KDFKeyFile}
+
+	if opts.Passphrase != "" {
+		salt := make([]byte, 16)
+
+		_, err := rand.Read(salt)
+		if err != nil {
+			return header, nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+
+		header = Encryption{
+			KDF:  KDFScrypt,
+			Salt: base64.StdEncoding.EncodeToString(salt),
+			N:    scryptN,
+			R:    scryptR,
+			P:    scryptP,
+		}
+	}
+
+	key, err := deriveKey(header, opts)
+	if err != nil {
+		return header, nil, err
+	}
+
+	header.Check, err = encryptValue(key, encryptionCheck)
+	if err != nil {
+		return header, nil, err
+	}
+
+	return header, key, nil
+}
+
+// encryptValue encrypts s with key. Empty values are left empty.
+func encryptValue(key []byte, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(s)+aead.Overhead())
+
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(s), nil)
+
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue decrypts s with key. Values that aren't encrypted, such as
+// ones that were edited by hand, are returned as-is.
+func decryptValue(key []byte, s string) (string, error) {
+	if !strings.HasPrefix(s, encryptedPrefix) {
+		return s, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value: too short")
+	}
+
+	b, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// secretFields returns pointers to every secret field of the peer.
+func (w *WgConfig) secretFields() []*string {
+	return []*string{&w.Config, &w.PrivateKey, &w.PreSharedKey, &w.PreviousPreSharedKey}
+}
+
+// applySecrets replaces every secret field of the configuration with the
+// result of fn.
+func (conf *Configuration) applySecrets(fn func(string) (string, error)) error {
+	var err error
+
+	for i := range conf.Peers {
+		for _, field := range conf.Peers[i].secretFields() {
+			*field, err = fn(*field)
+			if err != nil {
+				return fmt.Errorf("peer %v: %w", conf.Peers[i].ID, err)
+			}
+		}
+	}
+
+	for i := range conf.PresharedKeys {
+		conf.PresharedKeys[i].Key, err = fn(conf.PresharedKeys[i].Key)
+		if err != nil {
+			return fmt.Errorf("preshared key of %v & %v: %w", conf.PresharedKeys[i].Peers[0], conf.PresharedKeys[i].Peers[1], err)
+		}
+	}
+
+	return nil
+}
+
+// encrypted returns a copy of the configuration with its secret fields
+// encrypted.
+func (conf *Configuration) encrypted(opts EncryptionOptions) (*Configuration, error) {
+	header, key, err := newEncryption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := *conf
+	enc.Encryption = &header
+	enc.Peers = slices.Clone(conf.Peers)
+	enc.PresharedKeys = slices.Clone(conf.PresharedKeys)
+
+	err = enc.applySecrets(func(s string) (string, error) {
+		return encryptValue(key, s)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %w", err)
+	}
+
+	return &enc, nil
+}
+
+// decrypt decrypts the secret fields of the configuration in place, if it's
+// encrypted.
+func (conf *Configuration) decrypt(opts EncryptionOptions) error {
+	if conf.Encryption == nil {
+		return nil
+	}
+
+	key, err := deriveKey(*conf.Encryption, opts)
+	if err != nil {
+		return err
+	}
+
+	check, err := decryptValue(key, conf.Encryption.Check)
+	if err != nil || check != encryptionCheck {
+		return fmt.Errorf("wrong passphrase or key file")
+	}
+
+	err = conf.applySecrets(func(s string) (string, error) {
+		return decryptValue(key, s)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %w", err)
+	}
+
+	conf.Encryption = nil
+
+	return nil
+}
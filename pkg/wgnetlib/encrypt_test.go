@@ -0,0 +1,193 @@
+package gen
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var encryptFormats = []Format{FormatYAML, FormatJSON, FormatTOML}
+
+// testKeyFiles writes a raw and a base64-encoded key file, and returns their
+// paths.
+func testKeyFiles(t *testing.T) (raw, encoded string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"raw.key", "base64.key"} {
+		key := make([]byte, 32)
+
+		_, err := rand.Read(key)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+
+		b := key
+		if name == "base64.key" {
+			b = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+		}
+
+		err = os.WriteFile(filepath.Join(dir, name), b, 0o600)
+		if err != nil {
+			t.Fatalf("failed to write key file: %v", err)
+		}
+	}
+
+	return filepath.Join(dir, "raw.key"), filepath.Join(dir, "base64.key")
+}
+
+// saveEncrypted saves the test network in the given format, and returns the
+// path along with the network as it was before saving.
+func saveEncrypted(t *testing.T, format Format, opts EncryptionOptions) (string, *Configuration) {
+	t.Helper()
+
+	conf := loadTestNetwork(t)
+	path := filepath.Join(t.TempDir(), "network."+string(format))
+
+	err := conf.SaveWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("%v: failed to save: %v", format, err)
+	}
+
+	return path, conf
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	raw, encoded := testKeyFiles(t)
+
+	options := map[string]EncryptionOptions{
+		"passphrase":      {Passphrase: "correct horse battery staple"},
+		"raw key file":    {KeyFile: raw},
+		"base64 key file": {KeyFile: encoded},
+	}
+
+	for name, opts := range options {
+		for _, format := range encryptFormats {
+			path, want := saveEncrypted(t, format, opts)
+
+			got := &Configuration{}
+
+			err := got.LoadWithOptions(path, opts)
+			if err != nil {
+				t.Fatalf("%v %v: failed to load: %v", name, format, err)
+			}
+
+			if got.Encryption != nil {
+				t.Errorf("%v %v: expected the loaded configuration to be decrypted", name, format)
+			}
+
+			if !reflect.DeepEqual(got.Peers, want.Peers) {
+				t.Errorf("%v %v: peers differ after a round trip", name, format)
+			}
+
+			if !reflect.DeepEqual(got.PresharedKeys, want.PresharedKeys) {
+				t.Errorf("%v %v: preshared keys differ after a round trip", name, format)
+			}
+		}
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	raw, encoded := testKeyFiles(t)
+
+	tests := map[string]struct {
+		save EncryptionOptions
+		load EncryptionOptions
+	}{
+		"wrong passphrase": {
+			save: EncryptionOptions{Passphrase: "correct horse battery staple"},
+			load: EncryptionOptions{Passphrase: "incorrect horse"},
+		},
+		"wrong key file": {
+			save: EncryptionOptions{KeyFile: raw},
+			load: EncryptionOptions{KeyFile: encoded},
+		},
+	}
+
+	for name, tt := range tests {
+		for _, format := range encryptFormats {
+			path, _ := saveEncrypted(t, format, tt.save)
+
+			err := (&Configuration{}).LoadWithOptions(path, tt.load)
+			if err == nil {
+				t.Fatalf("%v %v: expected an error", name, format)
+			}
+
+			if errors.Is(err, ErrEncrypted) {
+				t.Errorf("%v %v: expected a wrong key error, got %v", name, format, err)
+			}
+		}
+	}
+}
+
+func TestEncryptionRequiresKey(t *testing.T) {
+	raw, _ := testKeyFiles(t)
+
+	options := map[string]EncryptionOptions{
+		"passphrase": {Passphrase: "correct horse battery staple"},
+		"key file":   {KeyFile: raw},
+	}
+
+	for name, opts := range options {
+		for _, format := range encryptFormats {
+			path, _ := saveEncrypted(t, format, opts)
+
+			err := (&Configuration{}).Load(path)
+			if !errors.Is(err, ErrEncrypted) {
+				t.Errorf("%v %v: expected ErrEncrypted, got %v", name, format, err)
+			}
+		}
+	}
+}
+
+func TestEncryptionPlaintextMetadata(t *testing.T) {
+	opts := EncryptionOptions{Passphrase: "correct horse battery staple"}
+
+	for _, format := range encryptFormats {
+		path, conf := saveEncrypted(t, format, opts)
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v: failed to read: %v", format, err)
+		}
+
+		s := string(b)
+
+		plain := []string{conf.GenerationParams.CIDR, conf.GenerationParams.Endpoint}
+		secret := []string{}
+
+		for _, w := range conf.Peers {
+			plain = append(plain, w.UID, w.IP, w.PublicKey)
+			secret = append(secret, w.PrivateKey, w.PreSharedKey)
+		}
+
+		for _, k := range conf.PresharedKeys {
+			secret = append(secret, k.Key)
+		}
+
+		for _, v := range plain {
+			if !strings.Contains(s, v) {
+				t.Errorf("%v: expected %v to stay readable", format, v)
+			}
+		}
+
+		for _, v := range secret {
+			if strings.Contains(s, v) {
+				t.Errorf("%v: expected %v to be encrypted", format, v)
+			}
+		}
+
+		// the configuration that was saved keeps its plaintext secrets
+		for _, w := range conf.Peers {
+			if strings.HasPrefix(w.PrivateKey, encryptedPrefix) {
+				t.Errorf("%v: the private key of peer %v was encrypted in memory", format, w.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package gen
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the compression format used for exported files.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionXZ   Compression = "xz"
+)
+
+const (
+	// ServerConfigFileName is the name of the server's config file within an
+	// exported directory.
+	ServerConfigFileName = "wg0.conf"
+	// ManifestFileName is the name of the index of all exported files within
+	// an exported directory.
+	ManifestFileName = "manifest.json"
+)
+
+// unsafeFileNameChars matches characters that should not be used in the
+// names of exported files.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ManifestEntry describes a single exported peer config file.
+type ManifestEntry struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	IP          string `json:"ip"`
+	SecondaryIP string `json:"secondaryIp,omitempty"`
+	PublicKey   string `json:"publicKey"`
+	IsServer    bool   `json:"isServer"`
+	IsHub       bool   `json:"isHub,omitempty"`
+	File        string `json:"file"`
+}
+
+// DirExporter writes the config of every peer to its own file named
+// <id>-<name>.conf within a directory, along with the server's config as
+// wg0.conf and a manifest.json index of every file. Files are optionally
+// compressed, in which case an extension such as .gz is appended.
+//
+// DirExporter implements PeerSink so that it can be used to stream peers
+// straight to disk while generating. Close must be called once all peers have
+// been written in order to complete the manifest.
+type DirExporter struct {
+	dir         string
+	compression Compression
+	manifest    *os.File
+	entries     int
+	// serverStreamed is set if the server config is being streamed via
+	// ServerWriter, in which case the server's Config field is expected to be
+	// empty when it is written.
+	serverStreamed bool
+}
+
+// NewDirExporter creates dir if needed and returns a DirExporter that writes
+// to it using the given compression. An empty compression is the same as
+// CompressionNone.
+func NewDirExporter(dir string, compression Compression) (*DirExporter, error) {
+	switch compression {
+	case "":
+		compression = CompressionNone
+	case CompressionNone, CompressionGzip, CompressionXZ:
+	default:
+		return nil, fmt.Errorf("unsupported compression: %v", compression)
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output directory %v: %w", dir, err)
+	}
+
+	manifest, err := os.Create(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %w", err)
+	}
+
+	// the manifest is streamed as a json array so that it never needs to be
+	// held in memory
+	_, err = io.WriteString(manifest, "[")
+	if err != nil {
+		manifest.Close()
+
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return &DirExporter{
+		dir:         dir,
+		compression: compression,
+		manifest:    manifest,
+	}, nil
+}
+
+// fileName returns the name, including the extension for the configured
+// compression, of the file that w will be exported to.
+func (e *DirExporter) fileName(w WgConfig) string {
+	name := ServerConfigFileName
+
+	if !w.IsServer {
+		name = fmt.Sprintf("%v.conf", w.ID)
+
+		safeName := unsafeFileNameChars.ReplaceAllString(w.Name, "-")
+		if safeName != "" {
+			name = fmt.Sprintf("%v-%v.conf", w.ID, safeName)
+		}
+	}
+
+	switch e.compression {
+	case CompressionGzip:
+		return name + ".gz"
+	case CompressionXZ:
+		return name + ".xz"
+	default:
+		return name
+	}
+}
+
+// compressedFile closes both a compressing writer and its underlying file.
+type compressedFile struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (c *compressedFile) Close() error {
+	err := c.WriteCloser.Close()
+	if err != nil {
+		c.f.Close()
+
+		return err
+	}
+
+	return c.f.Close()
+}
+
+// create creates the named file within the directory, wrapping it in the
+// configured compression.
+func (e *DirExporter) create(name string) (io.WriteCloser, error) {
+	f, err := os.OpenFile(filepath.Join(e.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %v: %w", name, err)
+	}
+
+	switch e.compression {
+	case CompressionGzip:
+		return &compressedFile{WriteCloser: gzip.NewWriter(f), f: f}, nil
+	case CompressionXZ:
+		xw, err := xz.NewWriter(f)
+		if err != nil {
+			f.Close()
+
+			return nil, fmt.Errorf("failed to create xz writer for %v: %w", name, err)
+		}
+
+		return &compressedFile{WriteCloser: xw, f: f}, nil
+	default:
+		return f, nil
+	}
+}
+
+// ServerWriter opens the server's config file for writing, so that it can be
+// passed to GenerateOptions.ServerWriter and streamed to disk while
+// generating. The caller must close the returned writer once generation has
+// finished.
+func (e *DirExporter) ServerWriter() (io.WriteCloser, error) {
+	w, err := e.create(e.fileName(WgConfig{IsServer: true}))
+	if err != nil {
+		return nil, err
+	}
+
+	e.serverStreamed = true
+
+	return w, nil
+}
+
+// Write exports a single peer's config and adds it to the manifest.
+func (e *DirExporter) Write(w WgConfig) error {
+	name := e.fileName(w)
+
+	if !w.IsServer || !e.serverStreamed {
+		f, err := e.create(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(f, w.Config)
+		if err != nil {
+			f.Close()
+
+			return fmt.Errorf("failed to write %v: %w", name, err)
+		}
+
+		err = f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close %v: %w", name, err)
+		}
+	}
+
+	b, err := json.Marshal(ManifestEntry{
+		ID:          w.ID,
+		Name:        w.Name,
+		IP:          w.IP,
+		SecondaryIP: w.SecondaryIP,
+		PublicKey:   w.PublicKey,
+		IsServer:    w.IsServer,
+		IsHub:       w.IsHub,
+		File:        name,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest entry for %v: %w", name, err)
+	}
+
+	separator := ",\n"
+	if e.entries == 0 {
+		separator = "\n"
+	}
+
+	_, err = fmt.Fprintf(e.manifest, "%v%s", separator, b)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	e.entries++
+
+	return nil
+}
+
+// Close completes and closes the manifest.
+func (e *DirExporter) Close() error {
+	_, err := io.WriteString(e.manifest, "\n]\n")
+	if err != nil {
+		e.manifest.Close()
+
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return e.manifest.Close()
+}
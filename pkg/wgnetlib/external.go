@@ -0,0 +1,96 @@
+package gen
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PrivateKeyPlaceholder is rendered instead of the private key in the configs
+// of external peers, which hold their own private keys.
+const PrivateKeyPlaceholder = "<your private key>"
+
+// ValidatePublicKey ensures that key is a base64-encoded Curve25519 public
+// key that can be used to establish a session, which excludes the points of
+// low order such as the all-zero key.
+func ValidatePublicKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("public key is empty")
+	}
+
+	k, err := wgtypes.ParseKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid public key %v: %w", key, err)
+	}
+
+	// any scalar results in the all-zero point for a low order point, which
+	// X25519 rejects
+	_, err = curve25519.X25519(curve25519.Basepoint, k[:])
+	if err != nil {
+		return fmt.Errorf("invalid public key %v: %w", key, err)
+	}
+
+	return nil
+}
+
+// applyExternalKeyRules is applyKeyRules for external peers, which only have
+// a public key. Their private key is never stored.
+func (conf *Configuration) applyExternalKeyRules(w *WgConfig) error {
+	if w.IsServer || w.IsHub {
+		return fmt.Errorf("peer %v is the server or a hub, so it can't be external", w.ID)
+	}
+
+	w.PrivateKey = ""
+
+	err := ValidatePublicKey(w.PublicKey)
+	if err != nil {
+		return fmt.Errorf("external peer %v: %w", w.ID, err)
+	}
+
+	if w.PreSharedKey == "" || conf.GenerationParams.RegenerateKeys || w.publicKeyReplaced() {
+		w.PreSharedKey = GeneratePreSharedKey()
+	}
+
+	w.KnownPublicKey = w.PublicKey
+
+	return nil
+}
+
+// publicKeyReplaced returns true if w is an external peer whose public key was
+// replaced since its preshared keys were generated. Peers saved before
+// KnownPublicKey existed are assumed to still have the same key.
+func (w *WgConfig) publicKeyReplaced() bool {
+	return w.External && w.KnownPublicKey != "" && w.KnownPublicKey != w.PublicKey
+}
+
+// validatePublicKeys ensures that no two peers share a public key, since
+// Wireguard identifies peers by their public keys.
+func validatePublicKeys(peers []WgConfig) error {
+	ids := make(map[string]uint, len(peers))
+
+	for _, w := range peers {
+		if w.PublicKey == "" {
+			continue
+		}
+
+		id, ok := ids[w.PublicKey]
+		if ok {
+			return fmt.Errorf("public key %v is used by both peer %v and peer %v", w.PublicKey, id, w.ID)
+		}
+
+		ids[w.PublicKey] = w.ID
+	}
+
+	return nil
+}
+
+// privateKey returns the peer's private key, or PrivateKeyPlaceholder for
+// external peers.
+func (w *WgConfig) privateKey() string {
+	if w.External {
+		return PrivateKeyPlaceholder
+	}
+
+	return w.PrivateKey
+}
@@ -0,0 +1,109 @@
+package gen
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newPublicKey returns the public key of a new private key.
+func newPublicKey(t *testing.T) string {
+	t.Helper()
+
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate private key: %v", err)
+	}
+
+	return k.PublicKey().String()
+}
+
+func TestValidatePublicKey(t *testing.T) {
+	tests := map[string]struct {
+		key string
+		ok  bool
+	}{
+		"valid":      {newPublicKey(t), true},
+		"empty":      {"", false},
+		"not base64": {"not a key", false},
+		"too short":  {"AAAA", false},
+		"all zero":   {"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", false},
+		"order 1":    {"AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", false},
+		"order 8":    {"4Ot6fDtBuK4WVuP68Z/EatoJjeucMrH9hmIFFl9JuAA=", false},
+	}
+
+	for name, tt := range tests {
+		err := ValidatePublicKey(tt.key)
+		if tt.ok != (err == nil) {
+			t.Errorf("%v: expected ok %v, got %v", name, tt.ok, err)
+		}
+	}
+}
+
+func TestExternalPublicKeyReplaced(t *testing.T) {
+	// the mesh has a preshared key for every pair with peer 4, instead of
+	// only the one with the server
+	for _, conf := range []*Configuration{loadTestNetwork(t), loadTestMesh(t)} {
+		mesh := conf.isMesh()
+
+		external := testPeer(t, conf, 4)
+		external.External = true
+		external.PublicKey = newPublicKey(t)
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err != nil {
+			t.Fatalf("mesh %v: failed to generate: %v", mesh, err)
+		}
+
+		before := pairKeys(conf)
+		psk := testPeer(t, conf, 4).PreSharedKey
+
+		// the same as a new device replacing the key by hand
+		publicKey := newPublicKey(t)
+		testPeer(t, conf, 4).PublicKey = publicKey
+
+		conf = regenerate(t, conf)
+
+		after := pairKeys(conf)
+
+		for id, key := range after {
+			has4 := id[0] == 4 || id[1] == 4
+
+			if has4 && key == before[id] {
+				t.Errorf("mesh %v: pair %v kept its preshared key after the public key was replaced", mesh, id)
+			}
+
+			if !has4 && key != before[id] {
+				t.Errorf("mesh %v: pair %v received a new preshared key", mesh, id)
+			}
+		}
+
+		w := testPeer(t, conf, 4)
+		if w.PreSharedKey == psk || w.PublicKey != publicKey || w.KnownPublicKey != publicKey {
+			t.Errorf("mesh %v: expected peer 4 to have new keys", mesh)
+		}
+
+		// once the new key is known, the preshared keys are kept again
+		kept := pairKeys(regenerate(t, conf))
+
+		for id, key := range after {
+			if kept[id] != key {
+				t.Errorf("mesh %v: pair %v received a new preshared key on the next run", mesh, id)
+			}
+		}
+	}
+}
+
+func TestDuplicatePublicKeys(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	external := testPeer(t, conf, 4)
+	external.External = true
+	external.PublicKey = testPeer(t, conf, 3).PublicKey
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err == nil || !strings.Contains(err.Error(), "is used by both peer 3 and peer 4") {
+		t.Errorf("expected the duplicate public key to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package gen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Firewall is the strategy used to generate the commands in the server's
+// PreUp, PostUp, PreDown and PostDown lines, which allow peers to reach the
+// server's network through ServerInterface.
+type Firewall string
+
+const (
+	// FirewallIPTables forwards & masquerades traffic using iptables for
+	// IPv4 networks and ip6tables for IPv6 networks. This is the default.
+	FirewallIPTables Firewall = "iptables"
+	// FirewallIP6Tables is the same as FirewallIPTables, except that only
+	// IPv6 networks get rules. This is useful for dual-stack networks where
+	// IPv4 traffic is already handled elsewhere. It requires an IPv6 CIDR or
+	// SecondaryCIDR.
+	FirewallIP6Tables Firewall = "ip6tables"
+	// FirewallNFTables forwards & masquerades traffic using a dedicated
+	// nftables table per Wireguard interface, which is deleted on shutdown.
+	FirewallNFTables Firewall = "nftables"
+	// FirewallFirewalld adds the Wireguard interface to the trusted zone and
+	// masquerades traffic from each network using firewalld rich rules.
+	FirewallFirewalld Firewall = "firewalld"
+	// FirewallNone doesn't generate any firewall commands.
+	FirewallNone Firewall = "none"
+	// FirewallCustom uses the PreUp, PostUp, PreDown and PostDown commands
+	// from the GenerationForm as-is.
+	FirewallCustom Firewall = "custom"
+)
+
+// firewallCommands holds the commands for each of the server's wg-quick hooks.
+// Multiple commands for the same hook are joined with "; ".
+type firewallCommands struct {
+	PreUp    []string
+	PostUp   []string
+	PreDown  []string
+	PostDown []string
+}
+
+// joined returns the commands for each hook as a single string per hook.
+func (c firewallCommands) joined() (preUp, postUp, preDown, postDown string) {
+	return strings.Join(c.PreUp, "; "),
+		strings.Join(c.PostUp, "; "),
+		strings.Join(c.PreDown, "; "),
+		strings.Join(c.PostDown, "; ")
+}
+
+// nonEmpty returns the non-empty values of s.
+func nonEmpty(s ...string) []string {
+	result := []string{}
+
+	for _, v := range s {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// firewallCommands generates the server's firewall commands for each of the
+// given networks, using the strategy from the GenerationForm.
+func (conf *Configuration) firewallCommands(networks []*net.IPNet) (firewallCommands, error) {
+	iface := conf.GenerationParams.ServerInterface
+	cmds := firewallCommands{}
+
+	switch conf.GenerationParams.Firewall {
+	case "", FirewallIPTables, FirewallIP6Tables:
+		seen := make(map[string]bool)
+
+		for _, n := range networks {
+			cmd := "iptables"
+			if IsIPv6(n.IP) {
+				cmd = "ip6tables"
+			}
+
+			if seen[cmd] || (conf.GenerationParams.Firewall == FirewallIP6Tables && cmd != "ip6tables") {
+				continue
+			}
+
+			seen[cmd] = true
+
+			cmds.PostUp = append(cmds.PostUp, fmt.Sprintf(
+				"%[1]v -A FORWARD -i %%i -j ACCEPT; %[1]v -A FORWARD -o %%i -j ACCEPT; %[1]v -t nat -A POSTROUTING -o %[2]v -j MASQUERADE",
+				cmd,
+				iface,
+			))
+			cmds.PostDown = append(cmds.PostDown, fmt.Sprintf(
+				"%[1]v -D FORWARD -i %%i -j ACCEPT; %[1]v -D FORWARD -o %%i -j ACCEPT; %[1]v -t nat -D POSTROUTING -o %[2]v -j MASQUERADE",
+				cmd,
+				iface,
+			))
+		}
+
+		if conf.GenerationParams.Firewall == FirewallIP6Tables && !seen["ip6tables"] {
+			return cmds, fmt.Errorf("the %v firewall requires an ipv6 cidr or secondary cidr", FirewallIP6Tables)
+		}
+	case FirewallNFTables:
+		// an inet table handles both address families, and deleting it
+		// removes every rule at once
+		table := "inet wgnetlib_%i"
+
+		cmds.PostUp = append(cmds.PostUp,
+			fmt.Sprintf("nft add table %v", table),
+			fmt.Sprintf("nft add chain %v forward { type filter hook forward priority 0 \\; }", table),
+			fmt.Sprintf("nft add rule %v forward iifname %%i accept", table),
+			fmt.Sprintf("nft add rule %v forward oifname %%i accept", table),
+			fmt.Sprintf("nft add chain %v postrouting { type nat hook postrouting priority 100 \\; }", table),
+		)
+
+		for _, n := range networks {
+			family := "ip"
+			if IsIPv6(n.IP) {
+				family = "ip6"
+			}
+
+			cmds.PostUp = append(cmds.PostUp, fmt.Sprintf(
+				"nft add rule %v postrouting %v saddr %v oifname %v masquerade",
+				table,
+				family,
+				n.String(),
+				iface,
+			))
+		}
+
+		cmds.PostDown = append(cmds.PostDown, fmt.Sprintf("nft delete table %v", table))
+	case FirewallFirewalld:
+		cmds.PostUp = append(cmds.PostUp, "firewall-cmd --zone=trusted --add-interface=%i")
+		cmds.PostDown = append(cmds.PostDown, "firewall-cmd --zone=trusted --remove-interface=%i")
+
+		for _, n := range networks {
+			family := "ipv4"
+			if IsIPv6(n.IP) {
+				family = "ipv6"
+			}
+
+			rule := fmt.Sprintf("'rule family=%v source address=%v masquerade'", family, n.String())
+
+			cmds.PostUp = append(cmds.PostUp, fmt.Sprintf("firewall-cmd --add-rich-rule=%v", rule))
+			cmds.PostDown = append(cmds.PostDown, fmt.Sprintf("firewall-cmd --remove-rich-rule=%v", rule))
+		}
+	case FirewallNone:
+	case FirewallCustom:
+		cmds.PreUp = nonEmpty(conf.GenerationParams.PreUp)
+		cmds.PostUp = nonEmpty(conf.GenerationParams.PostUp)
+		cmds.PreDown = nonEmpty(conf.GenerationParams.PreDown)
+		cmds.PostDown = nonEmpty(conf.GenerationParams.PostDown)
+	default:
+		return cmds, fmt.Errorf("unsupported firewall: %v", conf.GenerationParams.Firewall)
+	}
+
+	return cmds, nil
+}
@@ -1,15 +1,19 @@
 package gen
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/pterm/pterm"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -20,6 +24,10 @@ func (conf *Configuration) applySoftRules(w *WgConfig) error {
 		return fmt.Errorf("received nil w ptr when applying soft rules")
 	}
 
+	if w.UID == "" {
+		w.UID = GenerateUID()
+	}
+
 	if w.Name == "" {
 		w.Name = conf.GenerationParams.Name
 		w.Name = strings.ReplaceAll(w.Name, "${id}", strconv.FormatUint(uint64(w.ID), 10))
@@ -38,14 +46,17 @@ func (conf *Configuration) applySoftRules(w *WgConfig) error {
 	}
 
 	if w.AllowedIPs == "" {
-		if conf.GenerationParams.AllowedIPs == "" {
-			w.AllowedIPs = DefaultAllowedIPs
-		} else {
+		switch {
+		case w.IsHub: // clients only route the hub itself through it by default
+			w.AllowedIPs = w.hostAddresses()
+		case conf.GenerationParams.AllowedIPs != "":
 			w.AllowedIPs = conf.GenerationParams.AllowedIPs
+		default:
+			w.AllowedIPs = conf.defaultAllowedIPs()
 		}
 	}
 
-	if w.DNS == "" && !w.IsServer { // don't set the dns for the server
+	if w.DNS == "" && !w.IsServer && !w.IsHub { // don't set the dns for the server
 		w.DNS = conf.GenerationParams.DNS
 	}
 
@@ -54,10 +65,16 @@ func (conf *Configuration) applySoftRules(w *WgConfig) error {
 	}
 
 	if w.MTU == 0 {
-		w.MTU = DefaultMTU
+		switch {
+		case conf.GenerationParams.MTU != 0:
+			w.MTU = conf.GenerationParams.MTU
+		default:
+			w.MTU = DefaultMTU
+		}
 	}
 
-	if w.Endpoint == "" {
+	// in a mesh, every peer's endpoint is its own address
+	if w.Endpoint == "" && (!conf.isMesh() || w.IsServer) {
 		w.Endpoint = conf.GenerationParams.Endpoint
 	}
 
@@ -75,23 +92,50 @@ func (conf *Configuration) applyKeyRules(w *WgConfig) error {
 		return fmt.Errorf("received nil w ptr when applying key rules")
 	}
 
-	if w.PrivateKey == "" || w.PublicKey == "" || conf.GenerationParams.RegenerateKeys {
-		privKey, err := wgtypes.GeneratePrivateKey()
-		if err != nil {
-			return fmt.Errorf(
-				"error generating private key: %v",
-				err.Error(),
-			)
-		}
+	if w.External {
+		return conf.applyExternalKeyRules(w)
+	}
 
-		w.PrivateKey = privKey.String()
-		w.PublicKey = privKey.PublicKey().String()
+	if w.PrivateKey == "" || w.PublicKey == "" || conf.GenerationParams.RegenerateKeys {
+		return w.replaceKeys(time.Now().UTC())
 	}
 
-	if w.PreSharedKey == "" || conf.GenerationParams.RegenerateKeys {
+	if w.PreSharedKey == "" {
 		w.PreSharedKey = GeneratePreSharedKey()
 	}
 
+	if w.KeysCreatedAt == nil {
+		now := time.Now().UTC()
+		w.KeysCreatedAt = &now
+	}
+
+	return nil
+}
+
+// replaceKeys generates a new keypair and pre-shared key for the peer, and
+// sets KeysCreatedAt to now. If the peer already had a public key, it's kept
+// in PreviousPublicKey along with the previous pre-shared key, and RotatedAt
+// is set to now.
+func (w *WgConfig) replaceKeys(now time.Time) error {
+	privKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return fmt.Errorf(
+			"error generating private key: %v",
+			err.Error(),
+		)
+	}
+
+	if w.PublicKey != "" {
+		w.PreviousPublicKey = w.PublicKey
+		w.PreviousPreSharedKey = w.PreSharedKey
+		w.RotatedAt = &now
+	}
+
+	w.PrivateKey = privKey.String()
+	w.PublicKey = privKey.PublicKey().String()
+	w.PreSharedKey = GeneratePreSharedKey()
+	w.KeysCreatedAt = &now
+
 	return nil
 }
 
@@ -103,7 +147,7 @@ func (conf *Configuration) applyForcedRules(w *WgConfig) error {
 		return fmt.Errorf("received nil w ptr when applying forced rules")
 	}
 
-	if conf.GenerationParams.ForceAllowedIPs {
+	if conf.GenerationParams.ForceAllowedIPs && !w.IsHub { // hubs have their own AllowedIPs
 		w.AllowedIPs = conf.GenerationParams.AllowedIPs
 	}
 
@@ -115,7 +159,7 @@ func (conf *Configuration) applyForcedRules(w *WgConfig) error {
 		w.MTU = conf.GenerationParams.MTU
 	}
 
-	if conf.GenerationParams.ForceEndpoint {
+	if conf.GenerationParams.ForceEndpoint && (!conf.isMesh() || w.IsServer) {
 		w.Endpoint = conf.GenerationParams.Endpoint
 	}
 
@@ -123,7 +167,7 @@ func (conf *Configuration) applyForcedRules(w *WgConfig) error {
 		w.EndpointPort = conf.GenerationParams.EndpointPort
 	}
 
-	if conf.GenerationParams.ForceDNS && !w.IsServer { // don't set the DNS for the server
+	if conf.GenerationParams.ForceDNS && !w.IsServer && !w.IsHub { // don't set the DNS for the server
 		w.DNS = conf.GenerationParams.DNS
 	}
 
@@ -161,41 +205,11 @@ func validateServer(server WgConfig) error {
 	return nil
 }
 
+// GenerateConfig generates the Wireguard configuration for w, which is a
+// client of server, using DefaultClientTemplate. Use a Configuration to
+// render configs using custom templates.
 func (w *WgConfig) GenerateConfig(server WgConfig) (string, error) {
-	persistentKeepAlive := ""
-	if w.PersistentKeepAlive > 0 {
-		persistentKeepAlive = "\nPersistentKeepAlive = 25"
-	}
-
-	extra := ""
-	if w.Extra != "" {
-		extra = fmt.Sprintf("\n%v", w.Extra)
-	}
-
-	return fmt.Sprintf(`[Interface]%v
-PrivateKey = %s
-Address = %s/32
-DNS = %s
-MTU = %v
-
-[Peer]
-PublicKey = %s
-PresharedKey = %s
-Endpoint = %s:%v
-AllowedIPs = %v%v
-`,
-		extra,
-		w.PrivateKey,
-		w.IP,
-		w.DNS,
-		w.MTU,
-		server.PublicKey,
-		w.PreSharedKey,
-		w.Endpoint,
-		w.EndpointPort,
-		w.AllowedIPs,
-		persistentKeepAlive,
-	), nil
+	return execute(defaultTemplates.client, clientTemplateData(*w, server))
 }
 
 // GenerateServerConfig generates a Wireguard configuration that includes
@@ -207,46 +221,32 @@ func (w *WgConfig) GenerateServerConfig(
 	// serverPeers string,
 	spgz []string,
 	network *net.IPNet,
-) string {
-	maskSize, _ := network.Mask.Size()
+) (string, error) {
+	return w.generateServerConfig(conf, nil, spgz, network)
+}
 
-	extra := ""
-	if w.Extra != "" {
-		extra = fmt.Sprintf("\n%v", w.Extra)
-	}
+// generateServerConfig is the same as GenerateServerConfig, but also includes
+// a [Peer] section for each of the other nodes (the server & hubs).
+func (w *WgConfig) generateServerConfig(
+	conf *Configuration,
+	nodes []WgConfig,
+	spgz []string,
+	network *net.IPNet,
+) (string, error) {
+	var config strings.Builder
 
-	dns := ""
-	if w.DNS != "" {
-		dns = fmt.Sprintf("\nDNS = %v", w.DNS)
+	iface, err := w.serverInterfaceConfig(conf, network, nodes)
+	if err != nil {
+		return "", err
 	}
 
-	var config strings.Builder
-
-	config.WriteString(fmt.Sprintf(`[Interface]%v
-PrivateKey = %s
-Address = %s/%d
-ListenPort = %v%v
-MTU = %v
-PostUp = iptables -A FORWARD -i %%i -j ACCEPT; iptables -A FORWARD -o %%i -j ACCEPT; iptables -t nat -A POSTROUTING -o %v -j MASQUERADE
-PostDown = iptables -D FORWARD -i %%i -j ACCEPT; iptables -D FORWARD -o %%i -j ACCEPT; iptables -t nat -D POSTROUTING -o %v -j MASQUERADE
-
-`,
-		extra,
-		w.PrivateKey,
-		w.IP,
-		maskSize,
-		conf.GenerationParams.EndpointPort,
-		dns,
-		conf.GenerationParams.MTU,
-		conf.GenerationParams.ServerInterface,
-		conf.GenerationParams.ServerInterface,
-	))
+	config.WriteString(iface)
 
 	for _, sgz := range spgz {
 		if conf.UseGzipDuringProcessing {
 			s, err := GunzipString(sgz)
 			if err != nil {
-				log.Fatalf("failed to gunzip string: %v", err.Error())
+				return "", fmt.Errorf("failed to gunzip server peer: %w", err)
 			}
 
 			config.WriteString(s)
@@ -255,7 +255,68 @@ PostDown = iptables -D FORWARD -i %%i -j ACCEPT; iptables -D FORWARD -o %%i -j A
 		}
 	}
 
-	return config.String()
+	return config.String(), nil
+}
+
+// serverInterfaceConfig generates the [Interface] section of the server's
+// Wireguard configuration, followed by a [Peer] section for each of the other
+// nodes. This precedes all of the [Peer] sections for the clients.
+func (w *WgConfig) serverInterfaceConfig(conf *Configuration, network *net.IPNet, nodes []WgConfig) (string, error) {
+	addresses := fmt.Sprintf("%v/%v", w.IP, maskSize(network))
+	if w.SecondaryIP != "" && conf.secondaryNetwork != nil {
+		addresses = fmt.Sprintf("%v, %v/%v", addresses, w.SecondaryIP, maskSize(conf.secondaryNetwork))
+	}
+
+	// dual-stack servers need forwarding & NAT rules for both families
+	networks := []*net.IPNet{network}
+	if conf.secondaryNetwork != nil {
+		networks = append(networks, conf.secondaryNetwork)
+	}
+
+	cmds, err := conf.firewallCommands(networks)
+	if err != nil {
+		return "", err
+	}
+
+	return conf.renderServerInterface(*w, addresses, cmds, conf.nodeHubPeers(*w, nodes))
+}
+
+// serverPeerEntry returns the [Peer] section that the config of the server or
+// hub node needs for w, gzipped if UseGzipDuringProcessing is set.
+func (conf *Configuration) serverPeerEntry(node, w WgConfig) (string, error) {
+	serverPeer, err := conf.renderServerPeer(node, w)
+	if err != nil {
+		return "", err
+	}
+
+	if !conf.UseGzipDuringProcessing {
+		return serverPeer, nil
+	}
+
+	// this saves RAM while processing server peers but slows down processing
+	serverPeerGz, err := GzipString(serverPeer)
+	if err != nil {
+		return "", fmt.Errorf("failed to gzip server peer: %w", err)
+	}
+
+	return serverPeerGz, nil
+}
+
+// serverPeerEntries returns the [Peer] section that each of the nodes (the
+// server & hubs) needs for w, in the same order as nodes.
+func (conf *Configuration) serverPeerEntries(w WgConfig, nodes []WgConfig) ([]string, error) {
+	entries := make([]string, 0, len(nodes))
+
+	for _, node := range nodes {
+		entry, err := conf.serverPeerEntry(node, w)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
 }
 
 type IPAddress struct {
@@ -267,314 +328,774 @@ type IPAddress struct {
 	IsServerIP bool
 }
 
-// Generate is the primary function of this software. It will manipulate the
-// peers according to the defined generation parameters. You are responsible for
-// serializing & writing the resulting configuration to a yaml (or other
-// serializable) file.
-//
-// Depending on how large your CIDR network is, this may take a while and may
-// use a lot of RAM. Use care - make sure to save your valuable work in case
-// your system runs out of memory if you did something like a /8 block.
-//
-// If interactive is true, terminal progress bars and messages will be produced.
-func (conf *Configuration) Generate(interactive bool) error {
-	var err error
-
-	firstIP, cidrNet, err := net.ParseCIDR(conf.GenerationParams.CIDR)
+// parseNetwork validates the CIDR & server addresses from the GenerationForm
+// and stores the parsed values on the configuration.
+func (conf *Configuration) parseNetwork() error {
+	_, cidrNet, err := ParseAlignedCIDR(conf.GenerationParams.CIDR)
 	if err != nil {
-		return fmt.Errorf("failed to parse cidr: %w", err)
+		return err
 	}
 
-	if cidrNet == nil {
-		return fmt.Errorf("failed to determine cidr net, check the cidr value")
+	exclusions, err := conf.parseExclusions()
+	if err != nil {
+		return err
 	}
 
-	// assert that the user provided an aligned CIDR block
-	actualCIDR := fmt.Sprintf("%v", cidrNet)
-	if actualCIDR != conf.GenerationParams.CIDR {
-		return fmt.Errorf(
-			"cidr %v is not a correctly aligned subnet; use the correctly aligned subnet %v instead",
-			conf.GenerationParams.CIDR,
-			actualCIDR,
-		)
-	}
+	addresses := NewAddressRange(cidrNet)
+	exclusions = addresses.excludeSpans(exclusions)
 
 	parsedServer := net.ParseIP(conf.GenerationParams.Server)
 	if parsedServer == nil {
 		return fmt.Errorf("server is not an ip address: %v", conf.GenerationParams.Server)
 	}
 
-	if cidrNet != nil && !cidrNet.Contains(parsedServer) {
+	if !addresses.IsUsable(parsedServer) {
 		return fmt.Errorf(
-			"server must be an ip address within the range %v: %v",
+			"server must be a usable ip address within the range %v that isn't excluded: %v",
 			conf.GenerationParams.CIDR,
 			conf.GenerationParams.Server,
 		)
 	}
 
-	conf.firstIP = firstIP
 	conf.network = cidrNet
+	conf.addresses = addresses
 	conf.serverIP = parsedServer
 
-	// reset the peers map for the configuration - it's ephemeral
-	conf.peers = make(map[uint]WgConfig)
+	exclusions, err = conf.parseSecondaryNetwork(exclusions)
+	if err != nil {
+		return err
+	}
 
-	// First, generate keypairs for every possible IP address within the range,
-	// and while doing this, take note of which of them corresponds to the
-	// IP address within the range that equals the server's IP address.
-	//
-	// 1. Generate all possible WgConfig values, ensuring that old name/
-	//    description values are preserved, if possible.
+	if len(exclusions) > 0 {
+		return fmt.Errorf("excluded addresses %v are not within the cidr or secondary cidr", exclusions[0].s)
+	}
 
-	// reset the database if requested.
-	if conf.GenerationParams.ResetAll {
-		conf.Peers = []WgConfig{}
+	err = conf.parseHubs()
+	if err != nil {
+		return err
 	}
 
-	// edge case: All values in the database above the generated IP range need
-	// to be cleared out - in particular, they need to have their IsServer flag
-	// cleared. Start by doing this first.
-	for i := range conf.Peers {
-		if conf.Peers[i].IsServer {
-			conf.Peers[i].IsServer = false
-		}
+	return conf.parseReservations()
+}
+
+// peerSlot is a single peer that will be generated.
+type peerSlot struct {
+	id uint
+	ip IPAddress
+	// the index of the peer's previous values within the existing peers, or
+	// -1 if this is a new peer
+	existing int
+	// the name that the slot's address is reserved for, if any
+	name string
+}
 
-		conf.peers[uint(i)] = conf.Peers[i]
+// estimatePeers returns the number of peers that are expected to be generated.
+func (conf *Configuration) estimatePeers(existing []WgConfig) int {
+	if conf.GenerationParams.Sparse {
+		return len(existing) + 1
 	}
 
-	// take note of the total number of wireguard configs to generate so we
-	// can accurately render a progress bar readout.
 	wgs := EstimateNetworkSize(conf.network)
 
-	var multi pterm.MultiPrinter
+	maxPeers := int(conf.GenerationParams.MaxPeers)
+	if maxPeers > 0 && maxPeers < wgs {
+		wgs = maxPeers
+	}
 
-	var pbProcessed *pterm.ProgressbarPrinter
+	return wgs
+}
 
-	var pbPreProcessed *pterm.ProgressbarPrinter
+// denseSlots walks the CIDR and returns a slot for every usable IP address in
+// it (up to MaxPeers), ordered by ID. Existing peers keep their ID and, as long
+// as it's still usable, their IP address, so that removing a peer doesn't
+// affect any of the others. The remaining existing peers, such as every peer
+// after the CIDR changes, are assigned the free addresses in order. New peers
+// are numbered by their 1-based position within the CIDR, unless another peer
+// already has that ID.
+func (conf *Configuration) denseSlots(ctx context.Context, progress ProgressReporter, existing []WgConfig) ([]peerSlot, error) {
+	// IPv6 prefixes can't be allocated in full, so peers are allocated
+	// sparsely from the start of the prefix up to the configured limit.
+	maxPeers := int(conf.GenerationParams.MaxPeers)
+	if maxPeers == 0 && IsIPv6(conf.network.IP) {
+		return nil, fmt.Errorf("maxPeers must be set when using an ipv6 cidr: %v", conf.GenerationParams.CIDR)
+	}
 
-	var pbPostProcessing *pterm.ProgressbarPrinter
+	reserved, err := conf.reservedPeers(existing)
+	if err != nil {
+		return nil, err
+	}
 
-	pbProcessedIncrement := func() {
-		if interactive {
-			pbProcessed.Increment()
-		}
+	byIP := conf.existingByIP(existing)
+	claimed := make([]bool, len(existing))
+
+	serverExisting, ok := byIP[conf.serverIP.String()]
+	if !ok {
+		serverExisting = -1
 	}
 
-	pbPreProcessedIncrement := func() {
-		if interactive {
-			pbPreProcessed.Increment()
+	// reserved peers can only be placed at their reserved addresses. Like in
+	// sparseSlots, the server keeps the server address even if its name is
+	// reserved, and a new peer is created at the reserved address instead.
+	for ip, l := range reserved {
+		if l >= 0 && l == serverExisting {
+			reserved[ip] = -1
+		} else if l >= 0 {
+			claimed[l] = true
 		}
 	}
 
-	pbPostProcessingIncrement := func() {
-		if interactive {
-			pbPostProcessing.Increment()
+	numReserved := 0
+
+	// displaced holds the reservation that each existing peer at a reserved
+	// address, other than the reserved peer itself, was displaced by
+	displaced := make(map[int]string)
+
+	// take note of every IP address that we have to operate on, skipping the
+	// network, broadcast & excluded addresses
+	slots := []peerSlot{}
+	ip := conf.addresses.First()
+
+	for ip != nil && (maxPeers == 0 || len(slots) < maxPeers) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		progress.Increment(PhasePreProcessing)
+
+		// IDs are assigned once every existing peer has been placed
+		slot := peerSlot{
+			ip: IPAddress{
+				S:          ip.String(),
+				IP:         ip,
+				IsServerIP: ip.Equal(conf.serverIP),
+			},
+			existing: -1,
 		}
+
+		if name, ok := conf.reservations[slot.ip.S]; ok {
+			slot.name = name
+			slot.existing = reserved[slot.ip.S]
+			numReserved++
+
+			// a different peer at the reserved address has to move
+			if l, ok := byIP[slot.ip.S]; ok && !claimed[l] {
+				displaced[l] = name
+			}
+		} else if l, ok := byIP[slot.ip.S]; ok && !claimed[l] {
+			slot.existing = l
+			claimed[l] = true
+		}
+
+		slots = append(slots, slot)
+
+		ip = conf.addresses.After(ip)
 	}
 
-	if interactive {
-		multi = pterm.DefaultMultiPrinter
-		// need to go through the total list of IP addresses at least twice
-		pbPreProcessed, _ = pterm.DefaultProgressbar.WithWriter(multi.NewWriter()).WithTotal(wgs).Start("Pre-processing IPs")
-		pbProcessed, _ = pterm.DefaultProgressbar.WithWriter(multi.NewWriter()).WithTotal(wgs).Start("Peers configured")
-		pbPostProcessing, _ = pterm.DefaultProgressbar.WithWriter(multi.NewWriter()).WithTotal(wgs).Start(
-			"Peers post-processed",
+	if numReserved < len(conf.reservations) {
+		return nil, fmt.Errorf(
+			"only %v of the %v reservations are within the %v usable addresses allocated from %v",
+			numReserved,
+			len(conf.reservations),
+			len(slots),
+			conf.GenerationParams.CIDR,
 		)
-		_, _ = multi.Start()
 	}
 
-	// take note of every IP address that we have to operate on
-	allIPs := []IPAddress{}
-	ip := conf.firstIP
-	serverIPIndex := -1
+	// the peers whose addresses are no longer usable take the free ones.
+	// Reserved slots are never free, even if the reserved peer doesn't exist
+	// yet, since the peer placed there would be renamed.
+	free := 0
 
-	k := 0
+	for l := range existing {
+		if claimed[l] {
+			continue
+		}
 
-	for {
-		pbPreProcessedIncrement()
+		for free < len(slots) && (slots[free].existing >= 0 || slots[free].name != "") {
+			free++
+		}
 
-		ipa := IPAddress{
-			S:          ip.String(),
-			IP:         ip,
-			IsServerIP: false,
+		if free == len(slots) {
+			break
 		}
 
-		// if the IP address ends with .0 or .255, skip it
-		if strings.HasSuffix(ipa.S, ".0") || strings.HasSuffix(ipa.S, ".255") {
-			ip = NextIP(ip)
+		slots[free].existing = l
+		claimed[l] = true
+	}
 
+	// peers that no longer fit are removed, but a peer is never removed just
+	// to make room for a reservation
+	for l, name := range displaced {
+		if !claimed[l] {
+			return nil, fmt.Errorf(
+				"peer %v at %v is in the way of the reservation for %v, and no free address is left to move it to",
+				existing[l].ID,
+				existing[l].IP,
+				name,
+			)
+		}
+	}
+
+	assignIDs(slots, existing)
+
+	return slots, nil
+}
+
+// existingByIP indexes the existing peers by their IP address. Like in
+// sparseSlots, the previous server moves to the server address from the form,
+// unless another peer already has it.
+func (conf *Configuration) existingByIP(existing []WgConfig) map[string]int {
+	byIP := make(map[string]int, len(existing))
+	serverExisting := -1
+
+	for l, w := range existing {
+		if w.IsServer && serverExisting < 0 {
+			serverExisting = l
+		}
+
+		ip := net.ParseIP(w.IP)
+		if ip == nil {
 			continue
 		}
 
-		if !conf.network.Contains(ip) {
-			break
+		if _, ok := byIP[ip.String()]; !ok {
+			byIP[ip.String()] = l
+		}
+	}
+
+	if _, ok := byIP[conf.serverIP.String()]; !ok && serverExisting >= 0 {
+		ip := net.ParseIP(existing[serverExisting].IP)
+		if ip != nil && byIP[ip.String()] == serverExisting {
+			delete(byIP, ip.String())
 		}
 
-		if ipa.IP.Equal(conf.serverIP) {
-			ipa.IsServerIP = true
-			serverIPIndex = k
+		byIP[conf.serverIP.String()] = serverExisting
+	}
+
+	return byIP
+}
+
+// assignIDs gives each slot the ID of its existing peer, unless another peer
+// already has it, and gives every other slot its 1-based position if it's
+// free, or the next unused ID otherwise. The slots are then sorted by ID.
+func assignIDs(slots []peerSlot, existing []WgConfig) {
+	usedIDs := make(map[uint]bool, len(slots))
+
+	var maxID uint
+
+	for i := range slots {
+		if slots[i].existing < 0 {
+			continue
 		}
 
-		allIPs = append(allIPs, ipa)
-		ip = NextIP(ip)
-		k++
+		id := existing[slots[i].existing].ID
+		if id != 0 && !usedIDs[id] {
+			slots[i].id = id
+			usedIDs[id] = true
+			maxID = max(maxID, id)
+		}
 	}
 
-	ips := len(allIPs)
+	for i := range slots {
+		id := uint(i + 1)
+		if slots[i].id == 0 && !usedIDs[id] {
+			slots[i].id = id
+			usedIDs[id] = true
+			maxID = max(maxID, id)
+		}
+	}
 
+	for i := range slots {
+		if slots[i].id == 0 {
+			maxID++
+			slots[i].id = maxID
+		}
+	}
+
+	sort.Slice(slots, func(a, b int) bool {
+		return slots[a].id < slots[b].id
+	})
+}
+
+// Generate is the primary function of this software. It will manipulate the
+// peers according to the defined generation parameters. You are responsible for
+// serializing & writing the resulting configuration to a yaml (or other
+// serializable) file.
+//
+// Depending on how large your CIDR network is, this may take a while and may
+// use a lot of RAM. Use care - make sure to save your valuable work in case
+// your system runs out of memory if you did something like a /8 block.
+//
+// If interactive is true, progress is written to os.Stderr by a
+// TextProgressReporter.
+//
+// Deprecated: use GenerateWithOptions, which accepts any ProgressReporter.
+func (conf *Configuration) Generate(interactive bool) error {
+	opts := GenerateOptions{}
 	if interactive {
-		pbProcessed.Total = ips
-		pbPostProcessing.Total = ips
+		opts.Progress = NewTextProgressReporter(os.Stderr)
 	}
 
-	var progress int64
+	return conf.GenerateWithOptions(opts)
+}
 
-	var server *WgConfig
+// GenerateOptions controls optional behavior of GenerateWithOptions.
+type GenerateOptions struct {
+	// Progress receives progress updates while generating. If nil, progress
+	// is not reported.
+	Progress ProgressReporter
+	// Sink, if set, receives every generated peer as soon as it is ready
+	// instead of conf.Peers being replaced, so that the full set of peers is
+	// never held in memory at once. Peers are written in ID order, except for
+	// the hubs & server, which are written last once their configs are
+	// complete. If generation fails part way through, the sink will have
+	// already received some of the peers.
+	Sink PeerSink
+	// ServerWriter, if set, receives the server's config as it is being
+	// generated, instead of it being assembled in memory. When set, the
+	// server's Config field is left empty.
+	ServerWriter io.Writer
+	// Store, if set, is used instead of conf.Peers both to read the existing
+	// peers from and to write the generated peers to. The GenerationForm is
+	// saved to the store as well. Everything is written within a single
+	// transaction, so if generation fails part way through, the store is left
+	// untouched. Store cannot be combined with Sink.
+	Store Store
+}
+
+// GenerateWithOptions behaves the same as Generate, but allows for optional
+// behavior such as progress reporting to be configured.
+func (conf *Configuration) GenerateWithOptions(opts GenerateOptions) error {
+	return conf.GenerateContext(context.Background(), opts)
+}
+
+// GenerateContext behaves the same as GenerateWithOptions, but stops generating
+// as soon as ctx is cancelled or its deadline is exceeded. When that happens,
+// conf.Peers is left untouched and ctx.Err() is returned.
+func (conf *Configuration) GenerateContext(ctx context.Context, opts GenerateOptions) error {
+	var err error
+
+	if opts.Store != nil {
+		if opts.Sink != nil {
+			return fmt.Errorf("a store and a sink cannot both be used at the same time")
+		}
+
+		return conf.generateToStore(ctx, opts)
+	}
+
+	err = conf.parseNetwork()
+	if err != nil {
+		return err
+	}
+
+	err = conf.parseTemplates()
+	if err != nil {
+		return err
+	}
+
+	// First, generate keypairs for every possible IP address within the range,
+	// and while doing this, take note of which of them corresponds to the
+	// IP address within the range that equals the server's IP address.
+	//
+	// 1. Generate all possible WgConfig values, ensuring that old name/
+	//    description values are preserved, if possible.
+
+	// reset the database if requested. Note that IsServer is recalculated for
+	// every existing peer, so there is no need to clear it here.
+	existing := conf.Peers
+	if conf.GenerationParams.ResetAll {
+		existing = []WgConfig{}
+	}
+
+	err = validateUIDs(existing)
+	if err != nil {
+		return err
+	}
+
+	err = validatePublicKeys(existing)
+	if err != nil {
+		return err
+	}
+
+	conf.loadPresharedKeys(existing, conf.GenerationParams.RegenerateKeys || conf.GenerationParams.ResetAll)
+
+	progress := opts.Progress
+	if progress == nil {
+		progress = NopProgressReporter{}
+	}
+
+	// take note of the total number of wireguard configs to generate so we
+	// can accurately render a progress bar readout.
+	wgs := conf.estimatePeers(existing)
+
+	// need to go through the total list of IP addresses at least twice
+	progress.Start(PhasePreProcessing, wgs)
+	progress.Start(PhaseConfiguring, wgs)
+	progress.Start(PhasePostProcessing, wgs)
+
+	var slots []peerSlot
+
+	if conf.GenerationParams.Sparse {
+		slots, err = conf.sparseSlots(ctx, progress, existing)
+	} else {
+		slots, err = conf.denseSlots(ctx, progress, existing)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ips := len(slots)
+
+	err = conf.validateTopology(ips)
+	if err != nil {
+		return err
+	}
 
-	// serverpeer list but each item is gzipped to conserve memory
-	spgz := []string{}
+	mesh := conf.isMesh()
 
-	mutex := &sync.Mutex{}
+	serverSlot := -1
+	hubSlots := []int{}
 
-	// take note of the number of pre-existing peers so it doesn't have to be
-	// re-checked
-	numPeers := uint(len(conf.Peers))
+	// the server & hubs are generated separately from the clients
+	nodeSlots := make(map[int]bool, len(conf.hubs)+1)
+
+	for l := range slots {
+		switch {
+		case slots[l].ip.IsServerIP:
+			serverSlot = l
+			nodeSlots[l] = true
+		case conf.isHubIP(slots[l].ip.S):
+			hubSlots = append(hubSlots, l)
+			nodeSlots[l] = true
+		}
+	}
+
+	secondaryIPs, err := conf.allocateSecondaryIPs(existing, slots)
+	if err != nil {
+		return err
+	}
+
+	// only the peers that are kept can have subnets routed through them
+	routed := []WgConfig{}
+
+	for l, slot := range slots {
+		if slot.existing >= 0 && len(existing[slot.existing].RoutedSubnets) > 0 {
+			w := existing[slot.existing]
+			w.ID = slot.id
+			w.IsHub = !slot.ip.IsServerIP && nodeSlots[l]
+			routed = append(routed, w)
+		}
+	}
+
+	err = conf.parseRoutedSubnets(routed)
+	if err != nil {
+		return err
+	}
+
+	progress.Done(PhasePreProcessing)
+	progress.SetTotal(PhaseConfiguring, ips)
+	progress.SetTotal(PhasePostProcessing, ips)
+
+	var processed int64
+
+	var server *WgConfig
+
+	var hubs []WgConfig
+
+	// nodes are the server & hubs, which all peer with each other
+	var nodes []WgConfig
 
 	// prepDevice preps a single device, this is useful for processing
 	// the server first before everything else. The logic at this step
 	// is the same as all other devices though, only the server will behave
-	// slightly different in a few spots.
-	prepDevice := func(i uint, ip IPAddress) error {
+	// slightly different in a few spots. Along with the device, the [Peer]
+	// sections that each of the nodes needs for it are returned.
+	prepDevice := func(slot peerSlot) (WgConfig, []string, error) {
 		// attempt to find any existing record of this config
 		var w WgConfig
 
-		if numPeers >= i {
-			mutex.Lock()
-			w = conf.Peers[i-1] // no need to check if ok; zero-value is fine too
-			mutex.Unlock()
+		if slot.existing >= 0 {
+			w = existing[slot.existing] // existing is never written to, no need to lock
+		}
+
+		// a reserved slot only ever holds the peer that already has the
+		// reserved name, so that a peer's uid & keys are never handed out
+		// under another name
+		if slot.name != "" && slot.existing >= 0 && w.Name != slot.name {
+			return w, nil, fmt.Errorf("peer %v (%v) would be renamed to the reserved name %v", w.ID, w.Name, slot.name)
 		}
 
 		// update values. Note that in general, if a value in the form is
 		// left blank, the original value will be preserved where possible.
-		w.ID = i
-		w.IP = ip.S
-		w.IsServer = ip.IsServerIP
+		w.ID = slot.id
+		w.IP = slot.ip.S
+		w.SecondaryIP = secondaryIPs[slot.id]
+		w.IsServer = slot.ip.IsServerIP
+		w.IsHub = !w.IsServer && conf.isHubIP(slot.ip.S)
+
+		if slot.name != "" {
+			w.Name = slot.name
+		}
 
-		err = conf.applySoftRules(&w)
+		err := conf.applySoftRules(&w)
 		if err != nil {
-			return err
+			return w, nil, err
 		}
 
 		err = conf.applyForcedRules(&w)
 		if err != nil {
-			return err
+			return w, nil, err
 		}
 
-		err = conf.applyKeyRules(&w)
+		err = conf.applyHubRules(&w)
 		if err != nil {
-			return err
+			return w, nil, err
 		}
 
-		if server != nil && !w.IsServer {
-			// generate the peer config for this peer
-			peerConf, err := w.GenerateConfig(*server)
-			if err != nil {
-				return fmt.Errorf("error generating config for client %v: %w", i, err)
-			}
+		// a reserved name takes priority over forced names
+		if slot.name != "" {
+			w.Name = slot.name
+		}
 
-			w.Config = peerConf
+		// a peer that receives new keys can't keep the preshared keys it had
+		// with any of the other peers
+		if w.PublicKey == "" || (w.PrivateKey == "" && !w.External) || w.publicKeyReplaced() {
+			conf.psks.rekey(w.ID)
+		}
 
-			serverPeer := fmt.Sprintf(
-				"[Peer]\nPublicKey = %s\nAllowedIPs = %s/32\nPresharedKey = %s\n\n",
-				w.PublicKey,
-				w.IP,
-				w.PreSharedKey,
-			)
+		err = conf.applyKeyRules(&w)
+		if err != nil {
+			return w, nil, err
+		}
 
-			serverPeerGz := serverPeer
-			if conf.UseGzipDuringProcessing {
-				// this saves RAM while processing server peers
-				// but slows down processing
-				serverPeerGz, err = GzipString(serverPeer)
-				if err != nil {
-					return fmt.Errorf("failed to gzip server peer: %w", err)
-				}
-			}
+		// mesh configs can only be rendered once every peer has its keys
+		if server == nil || w.IsServer || w.IsHub || mesh {
+			return w, nil, nil
+		}
 
-			mutex.Lock()
+		// the key shared with the server is kept on the peer as well
+		w.PreSharedKey = conf.pairKey(server.ID, w.ID, w.PreSharedKey)
 
-			spgz = append(spgz, serverPeerGz)
-			mutex.Unlock()
+		// generate the peer config for this peer
+		w.Config, err = conf.renderClientConfig(w, *server, hubs)
+		if err != nil {
+			return w, nil, fmt.Errorf("error generating config for client %v: %w", slot.id, err)
 		}
 
-		mutex.Lock()
-		conf.peers[i] = w
-		mutex.Unlock()
+		serverPeersGz, err := conf.serverPeerEntries(w, nodes)
+		if err != nil {
+			return w, nil, err
+		}
 
-		return nil
+		return w, serverPeersGz, nil
 	}
 
-	prepFn := func(wg *sync.WaitGroup, progress *int64, i uint, ip IPAddress) error {
+	// workCtx is cancelled as soon as any worker fails, so that remaining
+	// workers can skip their work; firstErr holds the error that caused the
+	// failure.
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+
+	var errOnce sync.Once
+
+	// chunk holds the results of the chunk of peers currently being processed;
+	// each worker writes to its own index so no locking is needed
+	type chunkResult struct {
+		w           WgConfig
+		serverPeers []string
+	}
+
+	prepFn := func(wg *sync.WaitGroup, processed *int64, slot peerSlot, result *chunkResult) error {
 		defer wg.Done()
 
-		err := prepDevice(i, ip)
+		if workCtx.Err() != nil {
+			return nil
+		}
+
+		w, serverPeers, err := prepDevice(slot)
 		if err != nil {
 			return err
 		}
 
-		atomic.AddInt64(progress, 1)
+		*result = chunkResult{w: w, serverPeers: serverPeers}
 
-		pbProcessedIncrement()
+		atomic.AddInt64(processed, 1)
+
+		progress.Increment(PhaseConfiguring)
 
 		return nil
 	}
 
-	prepFnWrapped := func(wg *sync.WaitGroup, progress *int64, i uint, ip IPAddress) {
-		err := prepFn(wg, progress, i, ip)
+	prepFnWrapped := func(wg *sync.WaitGroup, processed *int64, slot peerSlot, result *chunkResult) {
+		err := prepFn(wg, processed, slot, result)
 		if err != nil {
-			log.Fatalf("error generating keys and configuring peers: %v", err.Error())
+			errOnce.Do(func() {
+				firstErr = fmt.Errorf("failed to configure peer %v (%v): %w", slot.id, slot.ip.S, err)
+				cancel()
+			})
 		}
 	}
 
 	// generate the server first - this allows more parallel processing to be
 	// done in one step
-	if serverIPIndex >= 0 && allIPs[serverIPIndex].IsServerIP {
-		err = prepDevice(uint(serverIPIndex)+1, allIPs[serverIPIndex])
+	if serverSlot < 0 {
+		return fmt.Errorf(
+			"server %v is not one of the %v usable addresses allocated from %v",
+			conf.GenerationParams.Server,
+			ips,
+			conf.GenerationParams.CIDR,
+		)
+	}
+
+	generatedServer, _, err := prepDevice(slots[serverSlot])
+	if err != nil {
+		return fmt.Errorf(
+			"failed to write server %v (%v): %w",
+			slots[serverSlot].id,
+			slots[serverSlot].ip.S,
+			err,
+		)
+	}
+
+	// assert that the server we just created is valid
+	server = &generatedServer
+
+	err = validateServer(*server)
+	if err != nil {
+		return err
+	}
+
+	// the hubs are generated next, since every client needs their keys too
+	if len(hubSlots) != len(conf.hubs) {
+		return fmt.Errorf(
+			"only %v of the %v hubs are within the %v usable addresses allocated from %v",
+			len(hubSlots),
+			len(conf.hubs),
+			ips,
+			conf.GenerationParams.CIDR,
+		)
+	}
+
+	hubs = make([]WgConfig, 0, len(hubSlots))
+
+	for _, l := range hubSlots {
+		hub, _, err := prepDevice(slots[l])
 		if err != nil {
-			return fmt.Errorf("failed to write server: %w", err)
+			return fmt.Errorf("failed to write hub %v (%v): %w", slots[l].id, slots[l].ip.S, err)
 		}
-	} else {
-		return fmt.Errorf("index of server not valid: %v", serverIPIndex)
-	}
 
-	// now find the server we just created and assert that it's valid
-	server = &WgConfig{}
+		err = validateServer(hub)
+		if err != nil {
+			return fmt.Errorf("invalid hub %v (%v): %w", slots[l].id, slots[l].ip.S, err)
+		}
 
-	foundServer := false
+		hubs = append(hubs, hub)
+	}
 
-	var serverIndex uint
+	nodes = append([]WgConfig{*server}, hubs...)
 
-	for k, v := range conf.peers {
-		if v.IsServer {
-			foundServer = true
-			*server = v
-			serverIndex = k
+	// The server's [Peer] sections are either streamed straight to the
+	// server writer, or collected so that the server config can be assembled
+	// once every peer is done. The hub configs always need to be assembled
+	// at the end, so their [Peer] sections are always collected. Each node
+	// has its own list, in the same order as nodes, since each node has its
+	// own preshared key with each peer.
+	//
+	// serverpeer lists but each item is gzipped to conserve memory
+	spgz := make([][]string, len(nodes))
 
-			break
+	if opts.ServerWriter != nil && !mesh {
+		iface, err := server.serverInterfaceConfig(conf, conf.network, nodes)
+		if err != nil {
+			return fmt.Errorf("failed to generate server config: %w", err)
+		}
+
+		_, err = io.WriteString(opts.ServerWriter, iface)
+		if err != nil {
+			return fmt.Errorf("failed to write server config: %w", err)
 		}
 	}
 
-	if !foundServer {
-		return fmt.Errorf("failed to find generated server")
+	// when not streaming to a sink, peers are collected here and only assigned
+	// to conf.Peers once everything has been generated successfully. Since a
+	// mesh is limited in size, its peers are always collected.
+	var result []WgConfig
+	if opts.Sink == nil || mesh {
+		result = make([]WgConfig, 0, ips)
 	}
 
-	err = validateServer(*server)
-	if err != nil {
-		return err
+	// the indexes of the server & hubs within result, keyed by ID
+	resultNodeIndexes := make(map[uint]int, len(nodes))
+
+	// emit passes a single generated peer along to wherever it needs to go.
+	// This is always called in slot order.
+	emit := func(l int, r chunkResult) error {
+		if nodeSlots[l] {
+			// the server & hubs are handled once their configs are complete
+			resultNodeIndexes[slots[l].id] = len(result)
+			if opts.Sink == nil || mesh {
+				result = append(result, WgConfig{})
+			}
+
+			return nil
+		}
+
+		if mesh {
+			result = append(result, r.w)
+			progress.Increment(PhasePostProcessing)
+
+			return nil
+		}
+
+		if opts.ServerWriter != nil {
+			s := r.serverPeers[0]
+			if conf.UseGzipDuringProcessing {
+				var err error
+
+				s, err = GunzipString(s)
+				if err != nil {
+					return fmt.Errorf("failed to gunzip server peer: %w", err)
+				}
+			}
+
+			_, err := io.WriteString(opts.ServerWriter, s)
+			if err != nil {
+				return fmt.Errorf("failed to write server config: %w", err)
+			}
+		}
+
+		for n := range nodes {
+			// the server's own [Peer] sections have already been streamed
+			if n == 0 && opts.ServerWriter != nil {
+				continue
+			}
+
+			spgz[n] = append(spgz[n], r.serverPeers[n])
+		}
+
+		if opts.Sink != nil {
+			err := opts.Sink.Write(r.w)
+			if err != nil {
+				return fmt.Errorf("failed to write peer %v (%v): %w", r.w.ID, r.w.IP, err)
+			}
+		} else {
+			result = append(result, r.w)
+		}
+
+		progress.Increment(PhasePostProcessing)
+
+		return nil
 	}
 
 	chunkSize := 1000
-	for j := 0; j < ips; j += chunkSize {
+	chunk := make([]chunkResult, chunkSize)
+
+	workers := runtime.GOMAXPROCS(0)
+
+	for j := 0; j < ips && workCtx.Err() == nil; j += chunkSize {
 		end := j + chunkSize
 		// Check if end is out of bounds
 		if end > ips {
@@ -582,47 +1103,125 @@ func (conf *Configuration) Generate(interactive bool) error {
 		}
 
 		var wg sync.WaitGroup
+
+		// a worker per CPU rather than a goroutine per peer, so that each
+		// worker's stack only needs to grow once
+		indexes := make(chan int)
+
+		for w := 0; w < workers; w++ {
+			go func(j int) {
+				for l := range indexes {
+					prepFnWrapped(&wg, &processed, slots[l], &chunk[l-j])
+				}
+			}(j)
+		}
+
 		for l := j; l < end; l++ {
-			i := uint(l + 1) // the primary key in the db is 1-based index, not 0
-			if allIPs[l].IsServerIP {
+			if nodeSlots[l] {
 				continue
 			}
 
 			wg.Add(1)
 
-			go prepFnWrapped(&wg, &progress, i, allIPs[l])
+			indexes <- l
 		}
+
+		close(indexes)
 		wg.Wait()
+
+		if workCtx.Err() != nil {
+			break
+		}
+
+		for l := j; l < end; l++ {
+			err = emit(l, chunk[l-j])
+			if err != nil {
+				return err
+			}
+
+			chunk[l-j] = chunkResult{}
+		}
 	}
 
-	if interactive {
-		pbProcessed.Current = ips - 1 // trick it into updating before stopping
-		pbProcessed.Increment()
-		pbProcessed.Stop()
+	if firstErr != nil {
+		return fmt.Errorf("error generating keys and configuring peers: %w", firstErr)
 	}
 
-	// 3. Finally, update the server config.
-	// log.Println("saving final server config")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	progress.Done(PhaseConfiguring)
+
+	if mesh {
+		result[resultNodeIndexes[server.ID]] = *server
+
+		err = conf.renderMesh(result)
+		if err != nil {
+			return err
+		}
+
+		progress.Increment(PhasePostProcessing)
+		progress.Done(PhasePostProcessing)
+
+		err = conf.emitMesh(opts, result)
+		if err != nil {
+			return err
+		}
 
-	server.Config = server.GenerateServerConfig(conf, spgz /* serverPeers.String() */, conf.network)
+		conf.PresharedKeys = conf.psks.snapshot()
+
+		return nil
+	}
 
-	conf.peers[serverIndex] = *server
+	// 3. Finally, update the server & hub configs.
+	if opts.ServerWriter == nil {
+		server.Config, err = server.generateServerConfig(conf, nodes, spgz[0], conf.network)
+		if err != nil {
+			return fmt.Errorf("failed to generate server config: %w", err)
+		}
+	} else {
+		server.Config = ""
+	}
 
-	// convert the peers map to a slice
-	conf.Peers = []WgConfig{}
+	progress.Increment(PhasePostProcessing)
 
-	for i := 1; i <= len(conf.peers); i++ {
-		conf.Peers = append(conf.Peers, conf.peers[uint(i)])
+	for i := range hubs {
+		hubs[i].Config, err = hubs[i].generateServerConfig(conf, nodes, spgz[i+1], conf.network)
+		if err != nil {
+			return fmt.Errorf("failed to generate config for hub %v (%v): %w", hubs[i].ID, hubs[i].IP, err)
+		}
 
-		pbPostProcessingIncrement()
+		progress.Increment(PhasePostProcessing)
 	}
 
-	// clear out the peers map to save memory
-	conf.peers = nil
+	progress.Done(PhasePostProcessing)
 
-	// log.Println("done")
+	if opts.Sink != nil {
+		for _, hub := range hubs {
+			err = opts.Sink.Write(hub)
+			if err != nil {
+				return fmt.Errorf("failed to write hub %v (%v): %w", hub.ID, hub.IP, err)
+			}
+		}
+
+		err = opts.Sink.Write(*server)
+		if err != nil {
+			return fmt.Errorf("failed to write server %v (%v): %w", server.ID, server.IP, err)
+		}
+
+		conf.PresharedKeys = conf.psks.snapshot()
+
+		return nil
+	}
+
+	for _, hub := range hubs {
+		result[resultNodeIndexes[hub.ID]] = hub
+	}
 
-	// pbProcessedUpdate(100)
+	result[resultNodeIndexes[server.ID]] = *server
+	conf.Peers = result
+	conf.PresharedKeys = conf.psks.snapshot()
 
 	return nil
 }
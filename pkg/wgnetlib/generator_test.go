@@ -0,0 +1,81 @@
+package gen
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// configuredCounter counts the peers that were configured, which the workers
+// report concurrently.
+type configuredCounter struct {
+	NopProgressReporter
+	configured atomic.Int64
+}
+
+func (c *configuredCounter) Increment(phase Phase) {
+	if phase == PhaseConfiguring {
+		c.configured.Add(1)
+	}
+}
+
+func TestGenerateWorkerError(t *testing.T) {
+	tests := map[string]struct {
+		// template fails to render for some of the clients
+		template string
+		want     string
+	}{
+		"single peer": {
+			template: "{{if eq .Peer.ID 2}}{{.Nope}}{{end}}",
+			want:     "error generating keys and configuring peers: failed to configure peer 2 (10.0.0.2): error generating config for client 2",
+		},
+		"every peer": {
+			template: "{{.Nope}}",
+			want:     "error generating keys and configuring peers: failed to configure peer ",
+		},
+	}
+
+	for name, tt := range tests {
+		// several chunks of peers, so that the later chunks are skipped once
+		// a worker fails in the first one
+		conf := &Configuration{
+			GenerationParams: GenerationForm{
+				CIDR:           "10.0.0.0/20",
+				Server:         "10.0.0.1",
+				Endpoint:       "5.5.5.5",
+				EndpointPort:   51820,
+				ClientTemplate: tt.template,
+			},
+		}
+
+		progress := &configuredCounter{}
+
+		err := conf.GenerateWithOptions(GenerateOptions{Progress: progress})
+		if err == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%v: expected the error to start with %q, got %q", name, tt.want, err.Error())
+		}
+
+		// only the first failure is reported, even if every worker failed
+		if n := strings.Count(err.Error(), "failed to configure peer"); n != 1 {
+			t.Errorf("%v: expected a single peer's error, got %v: %v", name, n, err)
+		}
+
+		if !strings.Contains(err.Error(), "can't evaluate field Nope") {
+			t.Errorf("%v: expected the template error to be wrapped, got %v", name, err)
+		}
+
+		// the workers stop once the context is cancelled, so at most the
+		// rest of the first chunk was configured
+		if got := progress.configured.Load(); got >= 1000 {
+			t.Errorf("%v: expected the remaining peers to be skipped, %v were configured", name, got)
+		}
+
+		if len(conf.Peers) != 0 {
+			t.Errorf("%v: expected no peers after a failed run, got %v", name, len(conf.Peers))
+		}
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"math"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/skip2/go-qrcode"
 )
@@ -43,16 +46,108 @@ func GeneratePreSharedKey() string {
 	return base64.StdEncoding.EncodeToString(key)
 }
 
+// GenerateUID returns a new random (version 4) UUID.
+func GenerateUID() string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// EstimateNetworkSize returns the number of addresses within ipNet. Networks
+// that contain more addresses than can be represented by an int, such as most
+// IPv6 prefixes, are reported as math.MaxInt.
 func EstimateNetworkSize(ipNet *net.IPNet) int {
-	prefixSize, _ := ipNet.Mask.Size()
+	prefixSize, bits := ipNet.Mask.Size()
+
+	hostBits := bits - prefixSize
+	if hostBits >= strconv.IntSize-1 {
+		return math.MaxInt
+	}
+
+	return 1 << hostBits
+}
 
-	// for IPv4
-	if ipNet.IP.To4() != nil {
-		return 1 << (32 - prefixSize)
+// ParseAlignedCIDR parses s as a CIDR block and asserts that it is correctly
+// aligned, e.g. 10.0.0.0/24 rather than 10.0.0.5/24.
+func ParseAlignedCIDR(s string) (net.IP, *net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse cidr: %w", err)
 	}
 
-	// for IPv6
-	return 1 << (128 - prefixSize)
+	if ipNet == nil {
+		return nil, nil, fmt.Errorf("failed to determine cidr net, check the cidr value")
+	}
+
+	// assert that the user provided an aligned CIDR block
+	actualCIDR := ipNet.String()
+	if actualCIDR != s {
+		return nil, nil, fmt.Errorf(
+			"cidr %v is not a correctly aligned subnet; use the correctly aligned subnet %v instead",
+			s,
+			actualCIDR,
+		)
+	}
+
+	return ip, ipNet, nil
+}
+
+func maskSize(ipNet *net.IPNet) int {
+	ones, _ := ipNet.Mask.Size()
+
+	return ones
+}
+
+// IsIPv6 returns true if ip is an IPv6 address that is not an IPv4-mapped
+// address.
+func IsIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil
+}
+
+// LastIP returns the last address within ipNet. For IPv4 networks this is the
+// broadcast address.
+func LastIP(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		ip = ipNet.IP.To16()
+	}
+
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^ipNet.Mask[i]
+	}
+
+	return last
+}
+
+// IsUsableHost returns true if ip can be assigned to a peer within ipNet. See
+// AddressRange for which addresses are usable.
+func IsUsableHost(ip net.IP, ipNet *net.IPNet) bool {
+	return NewAddressRange(ipNet).IsUsable(ip)
+}
+
+// HostPrefixLen returns the prefix length that addresses a single host of the
+// same address family as ip, i.e. 32 for IPv4 and 128 for IPv6.
+func HostPrefixLen(ip net.IP) int {
+	if IsIPv6(ip) {
+		return 128
+	}
+
+	return 32
+}
+
+// FormatEndpoint joins host and port into a Wireguard endpoint, wrapping IPv6
+// addresses in brackets.
+func FormatEndpoint(host string, port uint16) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
 }
 
 func NextIP(ip net.IP) net.IP {
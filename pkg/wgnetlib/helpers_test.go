@@ -0,0 +1,63 @@
+package gen
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatEndpoint(t *testing.T) {
+	tests := []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"5.5.5.5", 51820, "5.5.5.5:51820"},
+		{"2001:db8::1", 51820, "[2001:db8::1]:51820"},
+		{"[2001:db8::1]", 51820, "[2001:db8::1]:51820"},
+		{"::1", 1, "[::1]:1"},
+		{"vpn.example.com", 51999, "vpn.example.com:51999"},
+		{"localhost", 0, "localhost:0"},
+	}
+
+	for _, tt := range tests {
+		got := FormatEndpoint(tt.host, tt.port)
+		if got != tt.want {
+			t.Errorf("%v %v: expected %v, got %v", tt.host, tt.port, tt.want, got)
+		}
+	}
+}
+
+func TestHostPrefixLen(t *testing.T) {
+	tests := map[string]int{
+		"10.0.0.2":         32,
+		"fd00::2":          128,
+		"::ffff:10.0.0.2":  32,
+		"2001:db8::ffff:1": 128,
+	}
+
+	for ip, want := range tests {
+		got := HostPrefixLen(net.ParseIP(ip))
+		if got != want {
+			t.Errorf("%v: expected /%v, got /%v", ip, want, got)
+		}
+	}
+}
+
+func TestGenerateIPv6Golden(t *testing.T) {
+	conf := &Configuration{}
+
+	// an ipv6 network whose keys are fixed, with an ipv6 endpoint
+	err := conf.Load(filepath.Join("testdata", "network-ipv6.yml"))
+	if err != nil {
+		t.Fatalf("failed to load test network: %v", err)
+	}
+
+	err = conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	assertGolden(t, "server-ipv6.conf", testPeer(t, conf, 1).Config)
+	assertGolden(t, "client-ipv6.conf", testPeer(t, conf, 2).Config)
+}
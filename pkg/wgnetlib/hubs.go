@@ -0,0 +1,244 @@
+package gen
+
+import (
+	"fmt"
+	"net"
+)
+
+// Hub is an additional server within the CIDR, typically in a different region
+// than the primary server. Every client peers with every hub as well as the
+// primary server, and the hubs & primary server all peer with each other.
+type Hub struct {
+	// IP is the address of the hub within the CIDR.
+	IP string `yaml:"ip" json:"ip" toml:"ip"`
+	// Name optionally replaces the hub peer's name.
+	Name string `yaml:"name" json:"name" toml:"name"`
+	// Endpoint is the publicly reachable address of the hub.
+	Endpoint string `yaml:"endpoint" json:"endpoint" toml:"endpoint"`
+	// EndpointPort is the hub's publicly exposed wireguard port. If 0, the
+	// EndpointPort from the GenerationForm is used.
+	EndpointPort uint16 `yaml:"endpointPort" json:"endpointPort" toml:"endpointPort"`
+	// AllowedIPs are routed through the hub by clients. If empty, clients only
+	// route the hub's own address(es) through it. Since Wireguard routes each
+	// address through a single peer, these should not overlap with the
+	// AllowedIPs of the clients or of other hubs.
+	AllowedIPs string `yaml:"allowedIPs" json:"allowedIPs" toml:"allowedIPs"`
+}
+
+// HubPeer is a [Peer] section for a hub, server or mesh member, as seen from
+// another peer.
+type HubPeer struct {
+	// Peer is the hub or server.
+	Peer WgConfig
+	// Endpoint is the peer's endpoint as host:port, or empty if the peer has no
+	// endpoint.
+	Endpoint string
+	// AllowedIPs is the value of the [Peer] section's AllowedIPs line.
+	AllowedIPs string
+	// PresharedKey is the key shared between the peer and whoever the config is
+	// being rendered for.
+	PresharedKey string
+}
+
+// parseHubs validates the hubs from the GenerationForm and indexes them by ip
+// address. parseNetwork must be called first.
+func (conf *Configuration) parseHubs() error {
+	conf.hubs = make(map[string]int, len(conf.GenerationParams.Hubs))
+
+	for i, hub := range conf.GenerationParams.Hubs {
+		ip := net.ParseIP(hub.IP)
+		if ip == nil {
+			return fmt.Errorf("hub is not an ip address: %v", hub.IP)
+		}
+
+		if !conf.addresses.IsUsable(ip) {
+			return fmt.Errorf(
+				"hub must be a usable ip address within the range %v that isn't excluded: %v",
+				conf.GenerationParams.CIDR,
+				hub.IP,
+			)
+		}
+
+		if ip.Equal(conf.serverIP) {
+			return fmt.Errorf("hub %v must not be the same as the server", hub.IP)
+		}
+
+		if _, ok := conf.hubs[ip.String()]; ok {
+			return fmt.Errorf("hub %v is specified more than once", hub.IP)
+		}
+
+		if hub.Endpoint == "" {
+			return fmt.Errorf("hub %v has no endpoint", hub.IP)
+		}
+
+		conf.hubs[ip.String()] = i
+	}
+
+	return nil
+}
+
+// isHubIP returns true if s, which must be a normalized ip address such as
+// one returned by net.IP.String, is the address of a hub.
+func (conf *Configuration) isHubIP(s string) bool {
+	_, ok := conf.hubs[s]
+
+	return ok
+}
+
+// hubFor returns the hub declared in the GenerationForm for the ip address, if
+// any.
+func (conf *Configuration) hubFor(ip string) (Hub, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Hub{}, false
+	}
+
+	i, ok := conf.hubs[parsed.String()]
+	if !ok {
+		return Hub{}, false
+	}
+
+	return conf.GenerationParams.Hubs[i], true
+}
+
+// applyHubRules applies the values declared in the GenerationForm to a hub.
+// Like the server, hubs are determined by the GenerationForm, so these values
+// always take priority.
+func (conf *Configuration) applyHubRules(w *WgConfig) error {
+	if w == nil {
+		return fmt.Errorf("received nil w ptr when applying hub rules")
+	}
+
+	if !w.IsHub {
+		return nil
+	}
+
+	hub, ok := conf.hubFor(w.IP)
+	if !ok {
+		return fmt.Errorf("peer %v is not a hub", w.IP)
+	}
+
+	if hub.Name != "" {
+		w.Name = hub.Name
+	}
+
+	w.Endpoint = hub.Endpoint
+
+	w.EndpointPort = hub.EndpointPort
+	if w.EndpointPort == 0 {
+		w.EndpointPort = conf.GenerationParams.EndpointPort
+	}
+
+	// clients only route the hub's own addresses through it by default, not
+	// the AllowedIPs that every client has from the GenerationForm
+	w.AllowedIPs = hub.AllowedIPs
+	if w.AllowedIPs == "" {
+		w.AllowedIPs = w.hostAddresses()
+	}
+
+	return nil
+}
+
+// hubEndpoint returns the endpoint of a hub or server, or empty if it has none.
+func hubEndpoint(w WgConfig) string {
+	if w.Endpoint == "" {
+		return ""
+	}
+
+	return FormatEndpoint(w.Endpoint, w.EndpointPort)
+}
+
+// clientHubPeers returns the [Peer] sections that the client w needs for each
+// of the hubs.
+func (conf *Configuration) clientHubPeers(w WgConfig, hubs []WgConfig) []HubPeer {
+	result := make([]HubPeer, 0, len(hubs))
+
+	for _, hub := range hubs {
+		result = append(result, HubPeer{
+			Peer:         hub,
+			Endpoint:     hubEndpoint(hub),
+			AllowedIPs:   conf.hubAllowedIPs(hub),
+			PresharedKey: conf.pairKey(w.ID, hub.ID, w.PreSharedKey),
+		})
+	}
+
+	return result
+}
+
+// nodeHubPeers returns the [Peer] sections that the server or hub self needs
+// for each of the other nodes (the server & hubs). Nodes only route each
+// other's own addresses & routed subnets.
+func (conf *Configuration) nodeHubPeers(self WgConfig, nodes []WgConfig) []HubPeer {
+	result := make([]HubPeer, 0, len(nodes))
+
+	for _, n := range nodes {
+		if n.ID == self.ID {
+			continue
+		}
+
+		// before per-pair keys, the pair used the key of whichever node has
+		// the lower ID
+		legacy := self.PreSharedKey
+		if n.ID < self.ID {
+			legacy = n.PreSharedKey
+		}
+
+		result = append(result, HubPeer{
+			Peer:         n,
+			Endpoint:     hubEndpoint(n),
+			AllowedIPs:   n.routedAddresses(),
+			PresharedKey: conf.pairKey(self.ID, n.ID, legacy),
+		})
+	}
+
+	return result
+}
+
+// nodeConfigs regenerates the config of the server and every hub within peers,
+// in place, so that they include every client & other node in peers.
+func (conf *Configuration) nodeConfigs(peers []WgConfig) error {
+	nodes := []WgConfig{}
+
+	for _, w := range peers {
+		if w.IsServer || w.IsHub {
+			nodes = append(nodes, w)
+		}
+	}
+
+	// each node has its own preshared key with each client, so each node
+	// needs its own [Peer] sections
+	spgz := make([][]string, len(nodes))
+
+	for _, w := range peers {
+		if w.IsServer || w.IsHub {
+			continue
+		}
+
+		entries, err := conf.serverPeerEntries(w, nodes)
+		if err != nil {
+			return err
+		}
+
+		for n := range nodes {
+			spgz[n] = append(spgz[n], entries[n])
+		}
+	}
+
+	n := 0
+
+	for i := range peers {
+		if !peers[i].IsServer && !peers[i].IsHub {
+			continue
+		}
+
+		config, err := peers[i].generateServerConfig(conf, nodes, spgz[n], conf.network)
+		n++
+		if err != nil {
+			return fmt.Errorf("failed to generate server config for %v: %w", peers[i].IP, err)
+		}
+
+		peers[i].Config = config
+	}
+
+	return nil
+}
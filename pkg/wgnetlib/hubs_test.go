@@ -0,0 +1,87 @@
+package gen
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestHubs loads testdata/hubs.yml, the test network with the hub hub-eu
+// at 10.0.0.3, which routes 192.168.30.0/24, and the hub hub-us at 10.0.0.4,
+// which has its own port.
+func loadTestHubs(t *testing.T) *Configuration {
+	t.Helper()
+
+	conf := &Configuration{}
+
+	err := conf.Load(filepath.Join("testdata", "hubs.yml"))
+	if err != nil {
+		t.Fatalf("failed to load test hubs: %v", err)
+	}
+
+	return conf
+}
+
+func TestHubsGolden(t *testing.T) {
+	conf := loadTestHubs(t)
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	assertGolden(t, "hubs-server.conf", testPeer(t, conf, 1).Config)
+	assertGolden(t, "hubs-client.conf", testPeer(t, conf, 2).Config)
+	assertGolden(t, "hubs-hub.conf", testPeer(t, conf, 3).Config)
+}
+
+func TestHubPeers(t *testing.T) {
+	conf := loadTestHubs(t)
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	eu, us := testPeer(t, conf, 3), testPeer(t, conf, 4)
+
+	if !eu.IsHub || !us.IsHub || eu.Name != "hub-eu" || us.Name != "hub-us" {
+		t.Fatal("expected peers 3 & 4 to be the hubs")
+	}
+
+	// the [Peer] section of each hub, as seen by a client
+	tests := map[*WgConfig]string{
+		eu: "PublicKey = " + eu.PublicKey + "\n" +
+			"PresharedKey = " + pairKeys(conf)[newPairID(2, 3)] + "\n" +
+			"Endpoint = 6.6.6.6:51820\n" +
+			"AllowedIPs = 10.0.0.3/32, 192.168.30.0/24\n",
+		us: "PublicKey = " + us.PublicKey + "\n" +
+			"PresharedKey = " + pairKeys(conf)[newPairID(2, 4)] + "\n" +
+			"Endpoint = 7.7.7.7:51999\n" +
+			"AllowedIPs = 10.0.0.4/32\n",
+	}
+
+	client := testPeer(t, conf, 2).Config
+
+	for hub, want := range tests {
+		if !strings.Contains(client, want) {
+			t.Errorf("%v: expected the client config to contain:\n%v\ngot:\n%v", hub.Name, want, client)
+		}
+	}
+
+	// the server and the hubs each have a [Peer] section for every client &
+	// every other node
+	for _, id := range []uint{1, 3, 4} {
+		node := testPeer(t, conf, id)
+
+		if n := strings.Count(node.Config, "[Peer]"); n != 5 {
+			t.Errorf("peer %v: expected 5 [Peer] sections, got %v", id, n)
+		}
+
+		for _, w := range conf.Peers {
+			if w.ID != id && !strings.Contains(node.Config, "PublicKey = "+w.PublicKey) {
+				t.Errorf("peer %v: expected a [Peer] section for peer %v", id, w.ID)
+			}
+		}
+	}
+}
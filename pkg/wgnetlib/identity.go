@@ -0,0 +1,37 @@
+package gen
+
+import (
+	"fmt"
+)
+
+// validateUIDs ensures that no two peers share a UID. Peers without a UID
+// receive one when they're generated.
+func validateUIDs(peers []WgConfig) error {
+	ids := make(map[string]uint, len(peers))
+
+	for _, w := range peers {
+		if w.UID == "" {
+			continue
+		}
+
+		id, ok := ids[w.UID]
+		if ok {
+			return fmt.Errorf("uid %v is used by both peer %v and peer %v", w.UID, id, w.ID)
+		}
+
+		ids[w.UID] = w.ID
+	}
+
+	return nil
+}
+
+// PeerByUID returns the peer with the given UID.
+func (conf *Configuration) PeerByUID(uid string) (WgConfig, bool) {
+	for _, w := range conf.Peers {
+		if w.UID == uid {
+			return w, true
+		}
+	}
+
+	return WgConfig{}, false
+}
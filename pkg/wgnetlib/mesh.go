@@ -0,0 +1,167 @@
+package gen
+
+import (
+	"fmt"
+	"io"
+)
+
+// Topology determines which peers are connected to each other.
+type Topology string
+
+const (
+	// TopologyHubAndSpoke connects every client to the server (and any hubs),
+	// and is the default.
+	TopologyHubAndSpoke Topology = "hub-and-spoke"
+	// TopologyMesh connects every peer directly to every other peer. In this
+	// topology, each peer's Endpoint is the peer's own publicly reachable
+	// address, and only the server's Endpoint defaults to the one in the
+	// GenerationForm.
+	TopologyMesh Topology = "mesh"
+)
+
+// isMesh returns true if the full mesh topology is configured.
+func (conf *Configuration) isMesh() bool {
+	return conf.GenerationParams.Topology == TopologyMesh
+}
+
+// validateTopology ensures that the configured topology is supported and, for
+// a mesh, that it won't exceed the maximum mesh size with the given number of
+// members.
+func (conf *Configuration) validateTopology(members int) error {
+	switch conf.GenerationParams.Topology {
+	case "", TopologyHubAndSpoke:
+		return nil
+	case TopologyMesh:
+	default:
+		return fmt.Errorf("unsupported topology: %v", conf.GenerationParams.Topology)
+	}
+
+	if len(conf.GenerationParams.Hubs) > 0 {
+		return fmt.Errorf("hubs cannot be used with the %v topology", TopologyMesh)
+	}
+
+	maxMeshSize := conf.GenerationParams.MaxMeshSize
+	if maxMeshSize == 0 {
+		maxMeshSize = DefaultMaxMeshSize
+	}
+
+	if uint(members) > maxMeshSize {
+		return fmt.Errorf(
+			"a mesh of %v peers exceeds maxMeshSize %v, each peer's config would need %v [Peer] sections",
+			members,
+			maxMeshSize,
+			members-1,
+		)
+	}
+
+	return nil
+}
+
+// meshPeers returns the [Peer] sections that the mesh member w needs for each
+// of the other members. Pairs where neither member has an endpoint are left
+// out, since neither of them would be able to initiate a connection.
+func (conf *Configuration) meshPeers(w WgConfig, members []WgConfig) []HubPeer {
+	result := make([]HubPeer, 0, len(members))
+
+	for _, m := range members {
+		if m.ID == w.ID || (m.Endpoint == "" && w.Endpoint == "") {
+			continue
+		}
+
+		result = append(result, HubPeer{
+			Peer:         m,
+			Endpoint:     hubEndpoint(m),
+			AllowedIPs:   m.routedAddresses(),
+			PresharedKey: conf.pairKey(w.ID, m.ID, ""),
+		})
+	}
+
+	return result
+}
+
+// renderMesh renders the config of every member of a mesh, in place.
+func (conf *Configuration) renderMesh(members []WgConfig) error {
+	templates, err := conf.getTemplates()
+	if err != nil {
+		return err
+	}
+
+	network, secondaryNetwork := conf.networkStrings()
+
+	for i := range members {
+		w := members[i]
+
+		var listenPort uint16
+		if w.Endpoint != "" {
+			listenPort = w.EndpointPort
+		}
+
+		members[i].Config, err = execute(templates.mesh, MeshTemplateData{
+			Peer:             w,
+			PrivateKey:       w.privateKey(),
+			Params:           conf.GenerationParams,
+			Network:          network,
+			SecondaryNetwork: secondaryNetwork,
+			Address:          w.hostAddresses(),
+			ListenPort:       listenPort,
+			Peers:            conf.meshPeers(w, members),
+		})
+		if err != nil {
+			return fmt.Errorf("error generating mesh config for %v: %w", w.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// emitMesh passes the rendered members of a mesh along to wherever they need
+// to go once generation has finished.
+func (conf *Configuration) emitMesh(opts GenerateOptions, members []WgConfig) error {
+	serverIndex := -1
+
+	for i := range members {
+		if members[i].IsServer {
+			serverIndex = i
+
+			break
+		}
+	}
+
+	if opts.ServerWriter != nil && serverIndex >= 0 {
+		_, err := io.WriteString(opts.ServerWriter, members[serverIndex].Config)
+		if err != nil {
+			return fmt.Errorf("failed to write server config: %w", err)
+		}
+
+		members[serverIndex].Config = ""
+	}
+
+	if opts.Sink == nil {
+		conf.Peers = members
+
+		return nil
+	}
+
+	// like the other topologies, the server is written last
+	for i, w := range members {
+		if i == serverIndex {
+			continue
+		}
+
+		err := opts.Sink.Write(w)
+		if err != nil {
+			return fmt.Errorf("failed to write peer %v (%v): %w", w.ID, w.IP, err)
+		}
+	}
+
+	if serverIndex >= 0 {
+		w := members[serverIndex]
+
+		err := opts.Sink.Write(w)
+		if err != nil {
+			return fmt.Errorf("failed to write server %v (%v): %w", w.ID, w.IP, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package gen
+
+import (
+	"bufio"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestMesh loads testdata/mesh.yml, the test network as a mesh with the
+// preshared key of every pair saved. Peers 2 & 3 have endpoints, while peers
+// 4, 5 & 6 don't.
+func loadTestMesh(t *testing.T) *Configuration {
+	t.Helper()
+
+	conf := &Configuration{}
+
+	err := conf.Load(filepath.Join("testdata", "mesh.yml"))
+	if err != nil {
+		t.Fatalf("failed to load test mesh: %v", err)
+	}
+
+	return conf
+}
+
+// meshKeys returns the preshared key of each [Peer] section in config, keyed
+// by the peer's public key.
+func meshKeys(config string) map[string]string {
+	result := map[string]string{}
+
+	var publicKey string
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " = ")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "PublicKey":
+			publicKey = value
+			result[publicKey] = ""
+		case "PresharedKey":
+			result[publicKey] = value
+		}
+	}
+
+	return result
+}
+
+func TestMeshGolden(t *testing.T) {
+	conf := loadTestMesh(t)
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	assertGolden(t, "mesh-server.conf", testPeer(t, conf, 1).Config)
+	assertGolden(t, "mesh-client.conf", testPeer(t, conf, 2).Config)
+	assertGolden(t, "mesh-no-endpoint.conf", testPeer(t, conf, 4).Config)
+}
+
+func TestMeshOmitsPairsWithoutEndpoints(t *testing.T) {
+	conf := loadTestMesh(t)
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	// the peers each member is connected to
+	tests := map[uint][]uint{
+		1: {2, 3, 4, 5, 6},
+		2: {1, 3, 4, 5, 6},
+		3: {1, 2, 4, 5, 6},
+		4: {1, 2, 3},
+		5: {1, 2, 3},
+		6: {1, 2, 3},
+	}
+
+	for id, want := range tests {
+		keys := meshKeys(testPeer(t, conf, id).Config)
+
+		if len(keys) != len(want) {
+			t.Errorf("peer %v: expected %v [Peer] sections, got %v", id, len(want), len(keys))
+		}
+
+		for _, other := range want {
+			if _, ok := keys[testPeer(t, conf, other).PublicKey]; !ok {
+				t.Errorf("peer %v: expected a [Peer] section for %v", id, other)
+			}
+		}
+	}
+}
+
+func TestMeshPresharedKeysSymmetric(t *testing.T) {
+	conf := loadTestMesh(t)
+	conf.PresharedKeys = nil
+
+	var previous map[pairID]string
+
+	// the keys are generated on the first run, and kept on the second
+	for run := range 2 {
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err != nil {
+			t.Fatalf("run %v: failed to generate: %v", run, err)
+		}
+
+		saved := pairKeys(conf)
+		seen := map[string]bool{}
+
+		for _, a := range conf.Peers {
+			keys := meshKeys(a.Config)
+
+			for _, b := range conf.Peers {
+				key, ok := keys[b.PublicKey]
+				if !ok {
+					continue
+				}
+
+				if key == "" {
+					t.Errorf("run %v: peers %v & %v: expected a preshared key", run, a.ID, b.ID)
+				}
+
+				if other := meshKeys(b.Config)[a.PublicKey]; other != key {
+					t.Errorf("run %v: peers %v & %v: the preshared key differs between their configs", run, a.ID, b.ID)
+				}
+
+				if saved[newPairID(a.ID, b.ID)] != key {
+					t.Errorf("run %v: peers %v & %v: the preshared key differs from the saved key", run, a.ID, b.ID)
+				}
+
+				if a.ID < b.ID {
+					if seen[key] {
+						t.Errorf("run %v: peers %v & %v: the preshared key is used by another pair", run, a.ID, b.ID)
+					}
+
+					seen[key] = true
+				}
+			}
+		}
+
+		if previous != nil && !maps.Equal(previous, saved) {
+			t.Errorf("run %v: the preshared keys weren't kept", run)
+		}
+
+		previous = saved
+	}
+}
+
+func TestMeshMaxMeshSize(t *testing.T) {
+	tests := map[uint]bool{
+		5: false,
+		6: true,
+		0: true,
+	}
+
+	for size, ok := range tests {
+		conf := loadTestMesh(t)
+		conf.GenerationParams.MaxMeshSize = size
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+
+		switch {
+		case ok && err != nil:
+			t.Errorf("maxMeshSize %v: failed to generate: %v", size, err)
+		case !ok && (err == nil || !strings.Contains(err.Error(), "a mesh of 6 peers exceeds maxMeshSize 5")):
+			t.Errorf("maxMeshSize %v: expected the mesh to be too large, got %v", size, err)
+		}
+	}
+}
+
+func TestMeshRejectsHubs(t *testing.T) {
+	conf := loadTestMesh(t)
+	conf.GenerationParams.Hubs = []Hub{{IP: "10.0.0.2", Endpoint: "6.6.6.6"}}
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err == nil || !strings.Contains(err.Error(), "hubs cannot be used with the mesh topology") {
+		t.Errorf("expected hubs to be rejected, got %v", err)
+	}
+}
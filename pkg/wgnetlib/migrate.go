@@ -0,0 +1,481 @@
+package gen
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+)
+
+// MigrationStrategy determines how MigrateCIDR maps each peer's address to the
+// new CIDR.
+type MigrationStrategy string
+
+const (
+	// MigrateOffset keeps every peer at the same offset from the start of the
+	// CIDR, so that 10.0.0.5 in 10.0.0.0/24 becomes 10.1.0.5 in 10.1.0.0/24.
+	// This is the default.
+	MigrateOffset MigrationStrategy = "offset"
+	// MigratePack assigns the usable addresses of the new CIDR to the peers in
+	// the order of their previous addresses, leaving no gaps.
+	MigratePack MigrationStrategy = "pack"
+	// MigrateManual assigns the addresses from the Mapping of the migration,
+	// and packs every other peer around them.
+	MigrateManual MigrationStrategy = "manual"
+)
+
+// CIDRMigration describes how MigrateCIDR renumbers the network.
+type CIDRMigration struct {
+	// CIDR is the new CIDR.
+	CIDR string
+	// Strategy determines how the peers' addresses are mapped to the new
+	// CIDR. If empty, MigrateOffset is used.
+	Strategy MigrationStrategy
+	// Mapping is the new address of each of the peers listed in it, keyed by
+	// either the peer's previous address or its UID. Only used by
+	// MigrateManual.
+	Mapping map[string]string
+	// ExcludedAddresses replace the ExcludedAddresses of the GenerationForm
+	// that are within the previous CIDR. If nil, those are moved to the same
+	// offset within the new CIDR instead.
+	ExcludedAddresses []string
+}
+
+// AddressChange is a peer whose address was changed by MigrateCIDR.
+type AddressChange struct {
+	ID   uint
+	UID  string
+	Name string
+	From string
+	To   string
+}
+
+// ipToInt returns ip as an integer.
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(normalizeIP(ip))
+}
+
+// offsetIP returns the address at the same offset within to as ip is within
+// from. ok is false if to is too small.
+func offsetIP(ip net.IP, from, to *net.IPNet) (result net.IP, ok bool) {
+	offset := new(big.Int).Sub(ipToInt(ip), ipToInt(from.IP))
+
+	b := new(big.Int).Add(ipToInt(to.IP), offset).Bytes()
+
+	size := len(normalizeIP(to.IP))
+	if offset.Sign() < 0 || len(b) > size {
+		return nil, false
+	}
+
+	result = make(net.IP, size)
+	copy(result[size-len(b):], b)
+
+	return result, to.Contains(result)
+}
+
+// addressTranslator maps addresses within the previous CIDR to the new CIDR.
+// The addresses of peers follow the peers, and every other address is moved to
+// the same offset.
+type addressTranslator struct {
+	from  *net.IPNet
+	to    *net.IPNet
+	peers map[string]string
+}
+
+// ip translates a single address. Addresses outside of the previous CIDR are
+// returned as-is.
+func (t addressTranslator) ip(s string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil || !t.from.Contains(ip) {
+		return s, nil
+	}
+
+	if to, ok := t.peers[ip.String()]; ok {
+		return to, nil
+	}
+
+	to, ok := offsetIP(ip, t.from, t.to)
+	if !ok {
+		return "", fmt.Errorf("%v has no address at the same offset within %v", s, t.to)
+	}
+
+	return to.String(), nil
+}
+
+// cidr translates a single CIDR. The previous CIDR itself becomes the new
+// CIDR, and subnets within it keep their prefix length.
+func (t addressTranslator) cidr(s string) (string, error) {
+	// values that aren't cidrs within the previous cidr are left alone
+	ip, ipNet, parseErr := net.ParseCIDR(strings.TrimSpace(s))
+	if parseErr != nil || !t.from.Contains(ip) {
+		return s, nil
+	}
+
+	if ipNet.String() == t.from.String() {
+		return t.to.String(), nil
+	}
+
+	ones, _ := ipNet.Mask.Size()
+
+	to, err := t.ip(ip.String())
+	if err != nil {
+		return "", err
+	}
+
+	if ones < maskSize(t.to) {
+		return "", fmt.Errorf("%v doesn't fit within %v", s, t.to)
+	}
+
+	return fmt.Sprintf("%v/%v", to, ones), nil
+}
+
+// list translates each entry of a comma-separated list with fn.
+func (t addressTranslator) list(s string, fn func(string) (string, error)) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return s, nil
+	}
+
+	entries := strings.Split(s, ",")
+
+	for i, entry := range entries {
+		to, err := fn(strings.TrimSpace(entry))
+		if err != nil {
+			return "", err
+		}
+
+		entries[i] = to
+	}
+
+	return strings.Join(entries, ", "), nil
+}
+
+// span translates excluded addresses, keeping their original form.
+func (t addressTranslator) span(s string) (string, error) {
+	span, err := parseAddressSpan(s)
+	if err != nil {
+		return "", err
+	}
+
+	if !span.within(t.from) {
+		return s, nil
+	}
+
+	first, ok := offsetIP(span.first, t.from, t.to)
+	last, lastOK := offsetIP(span.last, t.from, t.to)
+
+	if !ok || !lastOK {
+		return "", fmt.Errorf("excluded addresses %v have no addresses at the same offset within %v", s, t.to)
+	}
+
+	_, ipNet, parseErr := net.ParseCIDR(span.s)
+
+	switch {
+	case parseErr == nil:
+		return fmt.Sprintf("%v/%v", first, maskSize(ipNet)), nil
+	case first.Equal(last):
+		return first.String(), nil
+	default:
+		return fmt.Sprintf("%v-%v", first, last), nil
+	}
+}
+
+// migrationAddresses maps the address of each of the peers to its new address
+// within addresses, according to the migration's strategy. peers must be
+// ordered by their previous addresses.
+func migrationAddresses(migration CIDRMigration, peers []WgConfig, from *net.IPNet, addresses *AddressRange) (map[string]string, error) {
+	// refuse early if the new cidr can't hold every peer
+	available := 0
+
+	for ip := addresses.First(); ip != nil && available < len(peers); ip = addresses.After(ip) {
+		available++
+	}
+
+	if available < len(peers) {
+		return nil, fmt.Errorf(
+			"cidr %v only has %v usable addresses, which is too few for %v peers",
+			migration.CIDR,
+			available,
+			len(peers),
+		)
+	}
+
+	result := make(map[string]string, len(peers))
+	used := make(map[string]bool, len(peers))
+
+	assign := func(w WgConfig, ip net.IP) error {
+		if !addresses.IsUsable(ip) {
+			return fmt.Errorf("%v is not a usable address within %v for peer %v", ip, migration.CIDR, w.ID)
+		}
+
+		if used[ip.String()] {
+			return fmt.Errorf("%v is assigned to more than one peer", ip)
+		}
+
+		result[w.IP] = ip.String()
+		used[ip.String()] = true
+
+		return nil
+	}
+
+	switch migration.Strategy {
+	case "", MigrateOffset:
+		for _, w := range peers {
+			ip, ok := offsetIP(net.ParseIP(w.IP), from, addresses.Network())
+			if !ok {
+				return nil, fmt.Errorf("peer %v (%v) has no address at the same offset within %v", w.ID, w.IP, migration.CIDR)
+			}
+
+			err := assign(w, ip)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	case MigrateManual:
+		for key, s := range migration.Mapping {
+			i := slices.IndexFunc(peers, func(w WgConfig) bool {
+				return w.UID == key || net.ParseIP(w.IP).Equal(net.ParseIP(key))
+			})
+			if i < 0 {
+				return nil, fmt.Errorf("no peer found with address or uid %v", key)
+			}
+
+			if _, ok := result[peers[i].IP]; ok {
+				return nil, fmt.Errorf("peer %v is mapped more than once", peers[i].ID)
+			}
+
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %v for %v", s, key)
+			}
+
+			err := assign(peers[i], ip)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case MigratePack:
+	default:
+		return nil, fmt.Errorf("unsupported migration strategy: %v", migration.Strategy)
+	}
+
+	// every other peer takes the next free address
+	var ip net.IP
+
+	for _, w := range peers {
+		if _, ok := result[w.IP]; ok {
+			continue
+		}
+
+		if ip == nil {
+			ip = addresses.First()
+		}
+
+		ip = addresses.Next(ip, used)
+		if ip == nil {
+			return nil, fmt.Errorf("cidr %v is too small to hold %v peers", migration.CIDR, len(peers))
+		}
+
+		err := assign(w, ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// MigrateCIDR renumbers the network into a new CIDR, and regenerates the
+// configuration. Every peer keeps its keys, UID, ID and metadata, and is
+// assigned a new address according to the migration's strategy. The server,
+// hubs, reservations, exclusions, DNS and AllowedIPs within the previous CIDR
+// are updated to match, both in the GenerationForm and for each peer.
+//
+// The peers whose address changed are returned, ordered by ID. If the new
+// CIDR can't hold every peer, or anything else fails, the configuration is
+// left untouched.
+func (conf *Configuration) MigrateCIDR(migration CIDRMigration) ([]AddressChange, error) {
+	err := conf.parseNetwork()
+	if err != nil {
+		return nil, err
+	}
+
+	from := conf.network
+
+	_, to, err := ParseAlignedCIDR(migration.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid migration cidr: %w", err)
+	}
+
+	form := conf.GenerationParams
+
+	translator := addressTranslator{from: from, to: to}
+
+	// exclusions within the previous cidr are replaced or moved
+	exclusions := []string{}
+
+	for _, s := range form.ExcludedAddresses {
+		span, err := parseAddressSpan(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded addresses: %w", err)
+		}
+
+		switch {
+		case !span.within(from):
+			exclusions = append(exclusions, s)
+		case migration.ExcludedAddresses == nil:
+			moved, err := translator.span(s)
+			if err != nil {
+				return nil, err
+			}
+
+			exclusions = append(exclusions, moved)
+		}
+	}
+
+	exclusions = append(exclusions, migration.ExcludedAddresses...)
+
+	addresses := NewAddressRange(to)
+
+	for _, s := range exclusions {
+		span, err := parseAddressSpan(s)
+		if err == nil && span.within(to) {
+			_ = addresses.Exclude(s)
+		}
+	}
+
+	peers := slices.Clone(conf.Peers)
+
+	slices.SortStableFunc(peers, func(a, b WgConfig) int {
+		return bytes.Compare(normalizeIP(net.ParseIP(a.IP)), normalizeIP(net.ParseIP(b.IP)))
+	})
+
+	// the addresses are normalized, so that the translator can look up
+	// addresses that were edited by hand, such as fd00:0::5, by their
+	// canonical form. The original addresses are kept for the changes.
+	original := make([]string, len(peers))
+
+	for i, w := range peers {
+		ip := net.ParseIP(w.IP)
+		if ip == nil || !from.Contains(ip) {
+			return nil, fmt.Errorf("peer %v has address %v, which is not within cidr %v", w.ID, w.IP, form.CIDR)
+		}
+
+		if i > 0 && ip.Equal(net.ParseIP(peers[i-1].IP)) {
+			return nil, fmt.Errorf("peers %v and %v both have address %v, generate the configuration first", peers[i-1].ID, w.ID, w.IP)
+		}
+
+		original[i] = w.IP
+		peers[i].IP = ip.String()
+	}
+
+	translator.peers, err = migrationAddresses(migration, peers, from, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	// the form & every peer are updated to use the new addresses
+	form.CIDR = to.String()
+	form.ExcludedAddresses = exclusions
+
+	form.Server, err = translator.ip(form.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate the server: %w", err)
+	}
+
+	form.Hubs = slices.Clone(form.Hubs)
+	for i := range form.Hubs {
+		form.Hubs[i].IP, err = translator.ip(form.Hubs[i].IP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate hub: %w", err)
+		}
+
+		form.Hubs[i].AllowedIPs, err = translator.list(form.Hubs[i].AllowedIPs, translator.cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate the allowed ips of hub %v: %w", form.Hubs[i].IP, err)
+		}
+	}
+
+	form.Reservations = slices.Clone(form.Reservations)
+	for i := range form.Reservations {
+		form.Reservations[i].IP, err = translator.ip(form.Reservations[i].IP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate the reservation for %v: %w", form.Reservations[i].Name, err)
+		}
+	}
+
+	form.DNS, err = translator.list(form.DNS, translator.ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate dns: %w", err)
+	}
+
+	form.AllowedIPs, err = translator.list(form.AllowedIPs, translator.cidr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate allowed ips: %w", err)
+	}
+
+	changes := []AddressChange{}
+
+	for i := range peers {
+		w := &peers[i]
+
+		to, ok := translator.peers[w.IP]
+		if !ok {
+			return nil, fmt.Errorf("no address was assigned to peer %v (%v)", w.ID, original[i])
+		}
+
+		if original[i] != to {
+			changes = append(changes, AddressChange{
+				ID:   w.ID,
+				UID:  w.UID,
+				Name: w.Name,
+				From: original[i],
+				To:   to,
+			})
+		}
+
+		w.IP = to
+
+		w.DNS, err = translator.list(w.DNS, translator.ip)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate the dns of peer %v: %w", w.ID, err)
+		}
+
+		w.AllowedIPs, err = translator.list(w.AllowedIPs, translator.cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate the allowed ips of peer %v: %w", w.ID, err)
+		}
+	}
+
+	slices.SortFunc(peers, func(a, b WgConfig) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	slices.SortFunc(changes, func(a, b AddressChange) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	// keys are never replaced by a migration
+	form.RegenerateKeys = false
+	form.ResetAll = false
+
+	previousForm, previousPeers := conf.GenerationParams, conf.Peers
+	conf.GenerationParams, conf.Peers = form, peers
+
+	err = conf.GenerateWithOptions(GenerateOptions{})
+
+	conf.GenerationParams.RegenerateKeys = previousForm.RegenerateKeys
+	conf.GenerationParams.ResetAll = previousForm.ResetAll
+
+	if err != nil {
+		conf.GenerationParams, conf.Peers = previousForm, previousPeers
+
+		return nil, err
+	}
+
+	return changes, nil
+}
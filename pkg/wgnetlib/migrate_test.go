@@ -0,0 +1,266 @@
+package gen
+
+import (
+	"cmp"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// removePeers removes the peers with the given ids.
+func removePeers(conf *Configuration, ids ...uint) {
+	conf.Peers = slices.DeleteFunc(conf.Peers, func(w WgConfig) bool {
+		return slices.Contains(ids, w.ID)
+	})
+}
+
+func TestMigrateCIDR(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, conf *Configuration)
+		migration CIDRMigration
+		// want is the address of each peer after migrating, keyed by id
+		want       map[uint]string
+		wantServer string
+		// wantDNS defaults to wantServer, which is the dns of the test network
+		wantDNS      string
+		wantExcluded []string
+		wantChanges  int
+	}{
+		{
+			name:      "offset",
+			migration: CIDRMigration{CIDR: "10.1.0.0/29"},
+			want: map[uint]string{
+				1: "10.1.0.1", 2: "10.1.0.2", 3: "10.1.0.3", 4: "10.1.0.4", 5: "10.1.0.5", 6: "10.1.0.6",
+			},
+			wantServer:  "10.1.0.1",
+			wantChanges: 6,
+		},
+		{
+			name: "offset into a larger cidr",
+			setup: func(t *testing.T, conf *Configuration) {
+				removePeers(conf, 2, 3)
+			},
+			migration:   CIDRMigration{CIDR: "10.1.0.0/24", Strategy: MigrateOffset},
+			want:        map[uint]string{1: "10.1.0.1", 4: "10.1.0.4", 5: "10.1.0.5", 6: "10.1.0.6"},
+			wantServer:  "10.1.0.1",
+			wantChanges: 4,
+		},
+		{
+			name: "pack",
+			setup: func(t *testing.T, conf *Configuration) {
+				removePeers(conf, 2, 3)
+			},
+			migration:   CIDRMigration{CIDR: "10.1.0.0/29", Strategy: MigratePack},
+			want:        map[uint]string{1: "10.1.0.1", 4: "10.1.0.2", 5: "10.1.0.3", 6: "10.1.0.4"},
+			wantServer:  "10.1.0.1",
+			wantChanges: 4,
+		},
+		{
+			name: "manual by address",
+			migration: CIDRMigration{
+				CIDR:     "10.1.0.0/29",
+				Strategy: MigrateManual,
+				Mapping:  map[string]string{"10.0.0.5": "10.1.0.6"},
+			},
+			want: map[uint]string{
+				1: "10.1.0.1", 2: "10.1.0.2", 3: "10.1.0.3", 4: "10.1.0.4", 5: "10.1.0.6", 6: "10.1.0.5",
+			},
+			wantServer:  "10.1.0.1",
+			wantChanges: 6,
+		},
+		{
+			name: "manual by uid",
+			migration: CIDRMigration{
+				CIDR:     "10.1.0.0/29",
+				Strategy: MigrateManual,
+				// the uid of peer 2
+				Mapping: map[string]string{"e0cd7f8e-7723-4bd1-9587-d12f932b5379": "10.1.0.6"},
+			},
+			want: map[uint]string{
+				1: "10.1.0.1", 2: "10.1.0.6", 3: "10.1.0.2", 4: "10.1.0.3", 5: "10.1.0.4", 6: "10.1.0.5",
+			},
+			wantServer:  "10.1.0.1",
+			wantChanges: 6,
+		},
+		{
+			name: "manual within the same cidr",
+			migration: CIDRMigration{
+				CIDR:     "10.0.0.0/29",
+				Strategy: MigrateManual,
+				Mapping:  map[string]string{"10.0.0.6": "10.0.0.2", "10.0.0.2": "10.0.0.6"},
+			},
+			want: map[uint]string{
+				1: "10.0.0.1", 2: "10.0.0.6", 3: "10.0.0.3", 4: "10.0.0.4", 5: "10.0.0.5", 6: "10.0.0.2",
+			},
+			wantServer:  "10.0.0.1",
+			wantChanges: 2,
+		},
+		{
+			name: "moves excluded addresses",
+			setup: func(t *testing.T, conf *Configuration) {
+				removePeers(conf, 6)
+				conf.GenerationParams.ExcludedAddresses = []string{"10.0.0.6"}
+			},
+			migration:    CIDRMigration{CIDR: "10.1.0.0/24"},
+			want:         map[uint]string{1: "10.1.0.1", 2: "10.1.0.2", 3: "10.1.0.3", 4: "10.1.0.4", 5: "10.1.0.5"},
+			wantServer:   "10.1.0.1",
+			wantExcluded: []string{"10.1.0.6"},
+			wantChanges:  5,
+		},
+		{
+			name: "replaces excluded addresses",
+			setup: func(t *testing.T, conf *Configuration) {
+				removePeers(conf, 6)
+				conf.GenerationParams.ExcludedAddresses = []string{"10.0.0.6"}
+			},
+			migration: CIDRMigration{
+				CIDR:              "10.1.0.0/29",
+				Strategy:          MigratePack,
+				ExcludedAddresses: []string{"10.1.0.2"},
+			},
+			want:         map[uint]string{1: "10.1.0.1", 2: "10.1.0.3", 3: "10.1.0.4", 4: "10.1.0.5", 5: "10.1.0.6"},
+			wantServer:   "10.1.0.1",
+			wantExcluded: []string{"10.1.0.2"},
+			wantChanges:  5,
+		},
+		{
+			name: "non-canonical address",
+			setup: func(t *testing.T, conf *Configuration) {
+				removePeers(conf, 2, 3)
+				// the dns refers to peer 5 by its canonical address
+				testPeer(t, conf, 5).IP = "::ffff:10.0.0.5"
+				conf.GenerationParams.DNS = "10.0.0.5"
+			},
+			migration:   CIDRMigration{CIDR: "10.1.0.0/29", Strategy: MigratePack},
+			want:        map[uint]string{1: "10.1.0.1", 4: "10.1.0.2", 5: "10.1.0.3", 6: "10.1.0.4"},
+			wantServer:  "10.1.0.1",
+			wantDNS:     "10.1.0.3",
+			wantChanges: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		conf := loadTestNetwork(t)
+		if tt.setup != nil {
+			tt.setup(t, conf)
+		}
+
+		keys := map[uint]string{}
+		for _, w := range conf.Peers {
+			keys[w.ID] = w.PublicKey
+		}
+
+		changes, err := conf.MigrateCIDR(tt.migration)
+		if err != nil {
+			t.Fatalf("%v: failed to migrate: %v", tt.name, err)
+		}
+
+		// migrating into a larger cidr fills it with new peers, which aren't
+		// checked here
+		for id, ip := range tt.want {
+			w := testPeer(t, conf, id)
+
+			if w.IP != ip {
+				t.Errorf("%v: expected peer %v at %v, got %v", tt.name, id, ip, w.IP)
+			}
+
+			if w.PublicKey != keys[id] {
+				t.Errorf("%v: peer %v didn't keep its keys", tt.name, id)
+			}
+		}
+
+		if len(changes) != tt.wantChanges {
+			t.Errorf("%v: expected %v changes, got %v", tt.name, tt.wantChanges, len(changes))
+		}
+
+		params := conf.GenerationParams
+
+		if params.CIDR != tt.migration.CIDR || params.Server != tt.wantServer {
+			t.Errorf("%v: expected cidr %v & server %v, got %v & %v", tt.name, tt.migration.CIDR, tt.wantServer, params.CIDR, params.Server)
+		}
+
+		wantDNS := cmp.Or(tt.wantDNS, tt.wantServer)
+		if params.DNS != wantDNS {
+			t.Errorf("%v: expected dns %v, got %v", tt.name, wantDNS, params.DNS)
+		}
+
+		if len(tt.wantExcluded) > 0 && !slices.Equal(params.ExcludedAddresses, tt.wantExcluded) {
+			t.Errorf("%v: expected excluded addresses %v, got %v", tt.name, tt.wantExcluded, params.ExcludedAddresses)
+		}
+	}
+}
+
+func TestMigrateCIDRMovesForm(t *testing.T) {
+	conf := loadTestNetwork(t)
+	removePeers(conf, 5, 6)
+
+	conf.GenerationParams.Hubs = []Hub{{IP: "10.0.0.2", Endpoint: "6.6.6.6", AllowedIPs: "10.0.0.2/32, 192.168.1.0/24"}}
+	conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.5"}}
+	conf.GenerationParams.DNS = "10.0.0.5, 1.1.1.1"
+	conf.GenerationParams.AllowedIPs = "10.0.0.0/29"
+	testPeer(t, conf, 3).AllowedIPs = "10.0.0.4/32, 0.0.0.0/0"
+
+	_, err := conf.MigrateCIDR(CIDRMigration{CIDR: "10.1.0.0/28"})
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	params := conf.GenerationParams
+
+	tests := map[string][2]string{
+		"hub":              {params.Hubs[0].IP, "10.1.0.2"},
+		"hub allowed ips":  {params.Hubs[0].AllowedIPs, "10.1.0.2/32, 192.168.1.0/24"},
+		"reservation":      {params.Reservations[0].IP, "10.1.0.5"},
+		"dns":              {params.DNS, "10.1.0.5, 1.1.1.1"},
+		"allowed ips":      {params.AllowedIPs, "10.1.0.0/28"},
+		"peer allowed ips": {testPeer(t, conf, 3).AllowedIPs, "10.1.0.4/32, 0.0.0.0/0"},
+		"reserved peer":    {peerAt(t, conf, "10.1.0.5").Name, "dns"},
+	}
+
+	for name, tt := range tests {
+		if tt[0] != tt[1] {
+			t.Errorf("%v: expected %v, got %v", name, tt[1], tt[0])
+		}
+	}
+}
+
+func TestMigrateCIDRRefusal(t *testing.T) {
+	tests := map[string]CIDRMigration{
+		"too small":        {CIDR: "10.1.0.0/30"},
+		"unaligned":        {CIDR: "10.1.0.1/29"},
+		"unknown strategy": {CIDR: "10.1.0.0/29", Strategy: "shuffle"},
+		"unknown peer": {
+			CIDR:     "10.1.0.0/29",
+			Strategy: MigrateManual,
+			Mapping:  map[string]string{"10.0.0.7": "10.1.0.2"},
+		},
+		"duplicate address": {
+			CIDR:     "10.1.0.0/29",
+			Strategy: MigrateManual,
+			Mapping:  map[string]string{"10.0.0.2": "10.1.0.6", "10.0.0.3": "10.1.0.6"},
+		},
+		"offset outside of the cidr": {CIDR: "10.1.0.0/30", Strategy: MigrateOffset},
+	}
+
+	for name, migration := range tests {
+		conf := loadTestNetwork(t)
+
+		form := conf.GenerationParams
+		peers := slices.Clone(conf.Peers)
+		keys := slices.Clone(conf.PresharedKeys)
+
+		_, err := conf.MigrateCIDR(migration)
+		if err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+
+		if !reflect.DeepEqual(conf.GenerationParams, form) {
+			t.Errorf("%v: the generation form was changed by a failed migration", name)
+		}
+
+		if !reflect.DeepEqual(conf.Peers, peers) || !reflect.DeepEqual(conf.PresharedKeys, keys) {
+			t.Errorf("%v: the peers were changed by a failed migration", name)
+		}
+	}
+}
@@ -1,80 +1,196 @@
 package gen
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // WgConfig represents a generated wireguard configuration for a single
 // peer/server.
 type WgConfig struct {
-	ID                  uint   `yaml:"id"`
-	Config              string `yaml:"config"`              // auto-generated
-	Name                string `yaml:"name"`                // user-configurable
-	Description         string `yaml:"description"`         // user-configurable
-	Extra               string `yaml:"extra"`               // user-configurable
-	IP                  string `yaml:"ip"`                  // user-configurable
-	AllowedIPs          string `yaml:"allowedIPs"`          // user-configurable
-	PersistentKeepAlive uint   `yaml:"persistentKeepAlive"` // user-configurable
-	MTU                 uint16 `yaml:"mtu"`                 // user-configurable
-	Endpoint            string `yaml:"endpoint"`            // user-configurable
-	EndpointPort        uint16 `yaml:"endpointPort"`        // user-configurable
-	DNS                 string `yaml:"dns"`                 // user-configurable
-	IsServer            bool   `yaml:"isServer"`            // not editable; determined by the GenerationForm
-	PrivateKey          string `yaml:"privateKey"`
-	PublicKey           string `yaml:"publicKey"`
-	PreSharedKey        string `yaml:"preSharedKey"`
+	ID                  uint   `yaml:"id" json:"id" toml:"id"`
+	UID                 string `yaml:"uid" json:"uid" toml:"uid"`                                                 // user-configurable; stable identity, generated if empty
+	Config              string `yaml:"config" json:"config" toml:"config"`                                        // auto-generated
+	Name                string `yaml:"name" json:"name" toml:"name"`                                              // user-configurable
+	Description         string `yaml:"description" json:"description" toml:"description"`                         // user-configurable
+	Extra               string `yaml:"extra" json:"extra" toml:"extra"`                                           // user-configurable
+	IP                  string `yaml:"ip" json:"ip" toml:"ip"`                                                    // user-configurable
+	SecondaryIP         string `yaml:"secondaryIp" json:"secondaryIp" toml:"secondaryIp"`                         // preserved across runs; determined by the GenerationForm
+	AllowedIPs          string `yaml:"allowedIPs" json:"allowedIPs" toml:"allowedIPs"`                            // user-configurable
+	PersistentKeepAlive uint   `yaml:"persistentKeepAlive" json:"persistentKeepAlive" toml:"persistentKeepAlive"` // user-configurable
+	MTU                 uint16 `yaml:"mtu" json:"mtu" toml:"mtu"`                                                 // user-configurable
+	Endpoint            string `yaml:"endpoint" json:"endpoint" toml:"endpoint"`                                  // user-configurable
+	EndpointPort        uint16 `yaml:"endpointPort" json:"endpointPort" toml:"endpointPort"`                      // user-configurable
+	DNS                 string `yaml:"dns" json:"dns" toml:"dns"`                                                 // user-configurable
+	IsServer            bool   `yaml:"isServer" json:"isServer" toml:"isServer"`                                  // not editable; determined by the GenerationForm
+	IsHub               bool   `yaml:"isHub" json:"isHub" toml:"isHub"`                                           // not editable; determined by the GenerationForm
+	PrivateKey          string `yaml:"privateKey" json:"privateKey" toml:"privateKey"`
+	PublicKey           string `yaml:"publicKey" json:"publicKey" toml:"publicKey"`
+	PreSharedKey        string `yaml:"preSharedKey" json:"preSharedKey" toml:"preSharedKey"`
+
+	// RoutedSubnets are the subnets behind this peer, such as the LAN of a
+	// router, which the other peers route through the tunnel to it. They must
+	// not overlap each other or the CIDR. User-configurable.
+	RoutedSubnets []string `yaml:"routedSubnets,omitempty" json:"routedSubnets,omitempty" toml:"routedSubnets,omitempty"`
+
+	// External peers generate their own keys and only share their public key,
+	// so PrivateKey is always empty and is never generated. Their configs are
+	// rendered with PrivateKeyPlaceholder instead. The server and hubs can't be
+	// external. User-configurable.
+	External bool `yaml:"external,omitempty" json:"external,omitempty" toml:"external,omitempty"`
+
+	// KnownPublicKey is the public key of an external peer that its preshared
+	// keys were generated for. When PublicKey is replaced, such as by a new
+	// device, the peer receives new preshared keys as well. Not editable.
+	KnownPublicKey string `yaml:"knownPublicKey,omitempty" json:"knownPublicKey,omitempty" toml:"knownPublicKey,omitempty"`
+
+	// PreviousPublicKey and PreviousPreSharedKey are the keys that the peer
+	// used before its keys were last replaced at RotatedAt, either by
+	// RotateKeys or by RegenerateKeys. Not editable.
+	PreviousPublicKey    string     `yaml:"previousPublicKey,omitempty" json:"previousPublicKey,omitempty" toml:"previousPublicKey,omitempty"`
+	PreviousPreSharedKey string     `yaml:"previousPreSharedKey,omitempty" json:"previousPreSharedKey,omitempty" toml:"previousPreSharedKey,omitempty"`
+	RotatedAt            *time.Time `yaml:"rotatedAt,omitempty" json:"rotatedAt,omitempty" toml:"rotatedAt,omitempty"`
+
+	// KeysCreatedAt is when the peer's current keys were generated, which
+	// KeyRotation.OlderThan is compared against. Keys that were added by hand
+	// are considered created when they're first generated with. Not editable.
+	KeysCreatedAt *time.Time `yaml:"keysCreatedAt,omitempty" json:"keysCreatedAt,omitempty" toml:"keysCreatedAt,omitempty"`
 }
 
 // GenerationForm represents a user-submitted form.
 type GenerationForm struct {
-	CIDR                     string `yaml:"cidr"`
-	DNS                      string `yaml:"dns"`
-	Server                   string `yaml:"server"`          // ip address of the server within CIDR
-	ServerInterface          string `yaml:"serverInterface"` // eth0, eno1, etc
-	Endpoint                 string `yaml:"endpoint"`
-	EndpointPort             uint16 `yaml:"endpointPort"` // publicly exposed wireguard server port
-	MTU                      uint16 `yaml:"mtu"`
-	AllowedIPs               string `yaml:"allowedIPs"`
-	PersistentKeepAlive      uint   `yaml:"persistentKeepAlive"` // if 0, do not set
-	Name                     string `yaml:"name"`                // for setting a placeholder name for peers
-	Description              string `yaml:"description"`         // for setting a placeholder desc. for peers
-	Extra                    string `yaml:"extra"`               // extra interface lines for peers
-	RegenerateKeys           bool   `yaml:"regenerateKeys"`
-	ResetAll                 bool   `yaml:"resetAll"`                 // if true, deletes everything
-	ForceAllowedIPs          bool   `yaml:"forceAllowedIPs"`          // replaces all previous values if true
-	ForcePersistentKeepAlive bool   `yaml:"forcePersistentKeepAlive"` // replaces all previous values if true
-	ForceMTU                 bool   `yaml:"forceMtu"`                 // replaces all previous values if true
-	ForceEndpoint            bool   `yaml:"forceEndpoint"`            // replaces all previous values if true
-	ForceEndpointPort        bool   `yaml:"forceEndpointPort"`        // replaces all previous values if true
-	ForceDNS                 bool   `yaml:"forceDns"`                 // replaces all previous values if true
-	ForceName                bool   `yaml:"forceName"`                // replaces all previous values if true
-	ForceDescription         bool   `yaml:"forceDescription"`         // replaces all previous values if true
-	ForceExtra               bool   `yaml:"forceExtra"`               // replaces all previous values if true
+	CIDR                     string `yaml:"cidr" json:"cidr" toml:"cidr"`
+	DNS                      string `yaml:"dns" json:"dns" toml:"dns"`
+	Server                   string `yaml:"server" json:"server" toml:"server"`                            // ip address of the server within CIDR
+	ServerInterface          string `yaml:"serverInterface" json:"serverInterface" toml:"serverInterface"` // eth0, eno1, etc
+	Endpoint                 string `yaml:"endpoint" json:"endpoint" toml:"endpoint"`
+	EndpointPort             uint16 `yaml:"endpointPort" json:"endpointPort" toml:"endpointPort"` // publicly exposed wireguard server port
+	MTU                      uint16 `yaml:"mtu" json:"mtu" toml:"mtu"`
+	AllowedIPs               string `yaml:"allowedIPs" json:"allowedIPs" toml:"allowedIPs"`
+	PersistentKeepAlive      uint   `yaml:"persistentKeepAlive" json:"persistentKeepAlive" toml:"persistentKeepAlive"` // if 0, do not set
+	Name                     string `yaml:"name" json:"name" toml:"name"`                                              // for setting a placeholder name for peers
+	Description              string `yaml:"description" json:"description" toml:"description"`                         // for setting a placeholder desc. for peers
+	Extra                    string `yaml:"extra" json:"extra" toml:"extra"`                                           // extra interface lines for peers
+	RegenerateKeys           bool   `yaml:"regenerateKeys" json:"regenerateKeys" toml:"regenerateKeys"`
+	ResetAll                 bool   `yaml:"resetAll" json:"resetAll" toml:"resetAll"`                                                 // if true, deletes everything
+	ForceAllowedIPs          bool   `yaml:"forceAllowedIPs" json:"forceAllowedIPs" toml:"forceAllowedIPs"`                            // replaces all previous values if true
+	ForcePersistentKeepAlive bool   `yaml:"forcePersistentKeepAlive" json:"forcePersistentKeepAlive" toml:"forcePersistentKeepAlive"` // replaces all previous values if true
+	ForceMTU                 bool   `yaml:"forceMtu" json:"forceMtu" toml:"forceMtu"`                                                 // replaces all previous values if true
+	ForceEndpoint            bool   `yaml:"forceEndpoint" json:"forceEndpoint" toml:"forceEndpoint"`                                  // replaces all previous values if true
+	ForceEndpointPort        bool   `yaml:"forceEndpointPort" json:"forceEndpointPort" toml:"forceEndpointPort"`                      // replaces all previous values if true
+	ForceDNS                 bool   `yaml:"forceDns" json:"forceDns" toml:"forceDns"`                                                 // replaces all previous values if true
+	ForceName                bool   `yaml:"forceName" json:"forceName" toml:"forceName"`                                              // replaces all previous values if true
+	ForceDescription         bool   `yaml:"forceDescription" json:"forceDescription" toml:"forceDescription"`                         // replaces all previous values if true
+	ForceExtra               bool   `yaml:"forceExtra" json:"forceExtra" toml:"forceExtra"`                                           // replaces all previous values if true
+	// MaxPeers limits the number of peers (including the server) that are
+	// allocated from the CIDR. If 0, every usable address in the CIDR gets a
+	// peer. IPv6 prefixes are far too large to allocate in full, so this is
+	// required for IPv6 CIDRs unless Sparse is set.
+	MaxPeers uint `yaml:"maxPeers" json:"maxPeers" toml:"maxPeers"`
+	// Sparse changes Generate so that instead of creating a peer for every
+	// usable address in the CIDR, only the server and the peers that already
+	// exist (typically provisioned via AllocatePeer) are generated.
+	Sparse bool `yaml:"sparse" json:"sparse" toml:"sparse"`
+	// SecondaryCIDR optionally assigns every peer a second address, typically
+	// so that a network can be dual-stack IPv4 and IPv6. Unlike the primary
+	// address, secondary addresses are preserved across runs as long as they
+	// still fall within SecondaryCIDR.
+	SecondaryCIDR string `yaml:"secondaryCidr" json:"secondaryCidr" toml:"secondaryCidr"`
+	// SecondaryServer is the ip address of the server within SecondaryCIDR. If
+	// empty, the first usable address in SecondaryCIDR is used.
+	SecondaryServer string `yaml:"secondaryServer" json:"secondaryServer" toml:"secondaryServer"`
+	// ExcludedAddresses are never assigned to peers, such as addresses that
+	// are reserved for other hosts on the same network. Each entry is either
+	// a single address such as 10.0.0.5, a CIDR such as 10.0.0.0/28, or an
+	// inclusive range such as 10.0.0.10-10.0.0.20, within either the CIDR or
+	// the SecondaryCIDR.
+	ExcludedAddresses []string `yaml:"excludedAddresses,omitempty" json:"excludedAddresses,omitempty" toml:"excludedAddresses,omitempty"`
+	// ClientTemplate is a text/template used to render each client's config
+	// instead of DefaultClientTemplate. It's executed with a
+	// ClientTemplateData.
+	ClientTemplate string `yaml:"clientTemplate" json:"clientTemplate" toml:"clientTemplate"`
+	// ServerTemplate is a text/template used to render the [Interface]
+	// section of the server's config instead of DefaultServerTemplate. It's
+	// executed with a ServerTemplateData.
+	ServerTemplate string `yaml:"serverTemplate" json:"serverTemplate" toml:"serverTemplate"`
+	// ServerPeerTemplate is a text/template used to render each [Peer]
+	// section of the server's config instead of DefaultServerPeerTemplate.
+	// It's executed with a ServerPeerTemplateData.
+	ServerPeerTemplate string `yaml:"serverPeerTemplate" json:"serverPeerTemplate" toml:"serverPeerTemplate"`
+	// Firewall is the strategy used to generate the server's PreUp, PostUp,
+	// PreDown and PostDown commands. If empty, FirewallIPTables is used.
+	Firewall Firewall `yaml:"firewall" json:"firewall" toml:"firewall"`
+	// PreUp, PostUp, PreDown and PostDown are the server's commands when
+	// Firewall is FirewallCustom, and are ignored otherwise.
+	PreUp    string `yaml:"preUp" json:"preUp" toml:"preUp"`
+	PostUp   string `yaml:"postUp" json:"postUp" toml:"postUp"`
+	PreDown  string `yaml:"preDown" json:"preDown" toml:"preDown"`
+	PostDown string `yaml:"postDown" json:"postDown" toml:"postDown"`
+	// Hubs are additional servers within the CIDR, each with its own
+	// endpoint. Clients peer with the server and every hub, and the server &
+	// hubs all peer with each other.
+	Hubs []Hub `yaml:"hubs,omitempty" json:"hubs,omitempty" toml:"hubs,omitempty"`
+	// Reservations pin peers to specific addresses by name, and every other
+	// peer is allocated around them.
+	Reservations []Reservation `yaml:"reservations,omitempty" json:"reservations,omitempty" toml:"reservations,omitempty"`
+	// Topology determines which peers are connected to each other. If empty,
+	// TopologyHubAndSpoke is used.
+	Topology Topology `yaml:"topology" json:"topology" toml:"topology"`
+	// MaxMeshSize is the largest number of peers that a mesh can have, since
+	// the size of every config grows with the size of the mesh. If 0,
+	// DefaultMaxMeshSize is used.
+	MaxMeshSize uint `yaml:"maxMeshSize" json:"maxMeshSize" toml:"maxMeshSize"`
+	// MeshTemplate is a text/template used to render each peer's config in a
+	// mesh instead of DefaultMeshTemplate. It's executed with a
+	// MeshTemplateData.
+	MeshTemplate string `yaml:"meshTemplate" json:"meshTemplate" toml:"meshTemplate"`
 }
 
 type Configuration struct {
+	// Version is the schema version of the configuration, used for migrating
+	// configurations that were saved by older versions of this library.
+	Version int `yaml:"version" json:"version" toml:"version"`
+
+	// Encryption is only set in saved configurations whose secret fields are
+	// encrypted. See EncryptionOptions.
+	Encryption *Encryption `yaml:"encryption,omitempty" json:"encryption,omitempty" toml:"encryption,omitempty"`
+
 	// These are tweakable parameters, some of which will erase or preserve
 	// fields between subsequent runs of this software.
-	GenerationParams GenerationForm `yaml:"generationParams"`
+	GenerationParams GenerationForm `yaml:"generationParams" json:"generationParams" toml:"generationParams"`
 
-	UseGzipDuringProcessing bool `yaml:"-"`
+	UseGzipDuringProcessing bool `yaml:"-" json:"-" toml:"-"`
 
 	// this is determined based on values from the GenerationParams
 	serverIP net.IP
 	// this is determined based on values from the GenerationParams
-	firstIP net.IP
-	// this is determined based on values from the GenerationParams
 	network *net.IPNet
-
-	// Human-readable names of devices, such as "laptop-01" and "server-01". The
-	// order of these will be preserved when CIDR changes occur. For example,
-	// the first device named "server-01" will have 192.168.1.1 for a CIDR of
-	// 192.168.1.0/24, but if you decide to later change the CIDR to
-	// 192.168.10.0/24, its new IP will be 192.168.10.1 since it's the first
-	// possible member of that network.
-	// Devices []string `yaml:"devices"`
+	// the usable addresses within network
+	addresses *AddressRange
+	// this is determined based on values from the GenerationParams
+	secondaryNetwork *net.IPNet
+	// the usable addresses within secondaryNetwork
+	secondaryAddresses *AddressRange
+	// this is determined based on values from the GenerationParams
+	secondaryServerIP net.IP
+	// hub indexes within the GenerationParams, keyed by ip address
+	hubs map[string]int
+	// reserved names from the GenerationParams, keyed by ip address
+	reservations map[string]string
+	// the parsed templates from the GenerationParams
+	templates *renderTemplates
+	// the preshared keys of each pair of peers while generating
+	psks *pskStore
+	// the subnets routed through each of the peers
+	routes []routedSubnet
 
 	// Each of the peers in the network will be stored in this. This can be huge
-	// if the chosen CIDR covers a large range.
-	Peers []WgConfig `yaml:"peers"`
+	// if the chosen CIDR covers a large range. Peers are identified by their
+	// UID, and keep their ID, keys & metadata when their IP address changes.
+	Peers []WgConfig `yaml:"peers" json:"peers" toml:"peers"`
 
-	peers map[uint]WgConfig
+	// The preshared key of every pair of peers that are connected to each
+	// other. These are preserved between runs, except for pairs where one of
+	// the peers receives new keys.
+	PresharedKeys []PresharedKey `yaml:"presharedKeys" json:"presharedKeys" toml:"presharedKeys"`
 }
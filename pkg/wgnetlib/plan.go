@@ -0,0 +1,242 @@
+package gen
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the values of secret fields, such as private keys, in a
+// Plan.
+const Redacted = "<redacted>"
+
+// FieldChange is a single field of a peer that Generate would change. Values
+// of secret fields are replaced with Redacted.
+type FieldChange struct {
+	// Field is the name of the field as it's saved, such as "endpoint".
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// PeerPlan is a peer that Generate would add, remove or change.
+type PeerPlan struct {
+	ID   uint   `json:"id"`
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	// Fields are the fields that would change. Only set for changed peers.
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// Plan is the difference between a configuration's peers and the peers that
+// Generate would produce from it. Each of its lists is ordered by ID.
+type Plan struct {
+	Added   []PeerPlan `json:"added"`
+	Removed []PeerPlan `json:"removed"`
+	Changed []PeerPlan `json:"changed"`
+	// Unchanged is the number of peers that would be kept as-is.
+	Unchanged int `json:"unchanged"`
+}
+
+// HasChanges returns true if Generate would change any of the peers.
+func (p *Plan) HasChanges() bool {
+	return len(p.Added) > 0 || len(p.Removed) > 0 || len(p.Changed) > 0
+}
+
+// planField is a field of WgConfig that is compared by Plan.
+type planField struct {
+	name   string
+	secret bool
+	value  func(w WgConfig) string
+}
+
+// planFields are the fields that Plan compares, in the order they're saved.
+// Config is only compared when the existing peer has one, since peers read
+// from a Store don't.
+var planFields = []planField{
+	{"id", false, func(w WgConfig) string { return fmt.Sprint(w.ID) }},
+	{"uid", false, func(w WgConfig) string { return w.UID }},
+	{"config", true, func(w WgConfig) string { return w.Config }},
+	{"name", false, func(w WgConfig) string { return w.Name }},
+	{"description", false, func(w WgConfig) string { return w.Description }},
+	{"extra", false, func(w WgConfig) string { return w.Extra }},
+	{"ip", false, func(w WgConfig) string { return w.IP }},
+	{"secondaryIp", false, func(w WgConfig) string { return w.SecondaryIP }},
+	{"allowedIPs", false, func(w WgConfig) string { return w.AllowedIPs }},
+	{"persistentKeepAlive", false, func(w WgConfig) string { return fmt.Sprint(w.PersistentKeepAlive) }},
+	{"mtu", false, func(w WgConfig) string { return fmt.Sprint(w.MTU) }},
+	{"endpoint", false, func(w WgConfig) string { return w.Endpoint }},
+	{"endpointPort", false, func(w WgConfig) string { return fmt.Sprint(w.EndpointPort) }},
+	{"dns", false, func(w WgConfig) string { return w.DNS }},
+	{"isServer", false, func(w WgConfig) string { return fmt.Sprint(w.IsServer) }},
+	{"isHub", false, func(w WgConfig) string { return fmt.Sprint(w.IsHub) }},
+	{"privateKey", true, func(w WgConfig) string { return w.PrivateKey }},
+	{"publicKey", false, func(w WgConfig) string { return w.PublicKey }},
+	{"preSharedKey", true, func(w WgConfig) string { return w.PreSharedKey }},
+	{"routedSubnets", false, func(w WgConfig) string { return strings.Join(w.RoutedSubnets, ", ") }},
+	{"external", false, func(w WgConfig) string { return fmt.Sprint(w.External) }},
+	{"knownPublicKey", false, func(w WgConfig) string { return w.KnownPublicKey }},
+	{"previousPublicKey", false, func(w WgConfig) string { return w.PreviousPublicKey }},
+	{"previousPreSharedKey", true, func(w WgConfig) string { return w.PreviousPreSharedKey }},
+	{"rotatedAt", false, func(w WgConfig) string {
+		if w.RotatedAt == nil {
+			return ""
+		}
+
+		return w.RotatedAt.Format(time.RFC3339)
+	}},
+	{"keysCreatedAt", false, func(w WgConfig) string {
+		if w.KeysCreatedAt == nil {
+			return ""
+		}
+
+		return w.KeysCreatedAt.Format(time.RFC3339)
+	}},
+}
+
+// redact replaces secret values, leaving empty values as-is so that secrets
+// being set or cleared are still visible.
+func redact(s string) string {
+	if s == "" {
+		return s
+	}
+
+	return Redacted
+}
+
+// diffPeer returns the fields that differ between the existing peer and the
+// generated peer.
+func diffPeer(existing, generated WgConfig) []FieldChange {
+	changes := []FieldChange{}
+
+	for _, f := range planFields {
+		if f.name == "config" && existing.Config == "" {
+			continue
+		}
+
+		from, to := f.value(existing), f.value(generated)
+		if from == to {
+			continue
+		}
+
+		if f.secret {
+			from, to = redact(from), redact(to)
+		}
+
+		changes = append(changes, FieldChange{Field: f.name, From: from, To: to})
+	}
+
+	return changes
+}
+
+func newPeerPlan(w WgConfig) PeerPlan {
+	return PeerPlan{ID: w.ID, UID: w.UID, Name: w.Name, IP: w.IP}
+}
+
+// diffPeers compares the existing peers with the generated peers. Peers are
+// matched by UID, or by ID if the existing peer doesn't have a UID yet.
+func diffPeers(existing, generated []WgConfig) *Plan {
+	plan := &Plan{Added: []PeerPlan{}, Removed: []PeerPlan{}, Changed: []PeerPlan{}}
+
+	byUID := make(map[string]int, len(existing))
+	byID := make(map[uint]int)
+
+	for i, w := range existing {
+		if w.UID != "" {
+			byUID[w.UID] = i
+		} else {
+			byID[w.ID] = i
+		}
+	}
+
+	matched := make([]bool, len(existing))
+
+	for _, w := range generated {
+		i, ok := byUID[w.UID]
+		if !ok {
+			i, ok = byID[w.ID]
+		}
+
+		if !ok || matched[i] {
+			plan.Added = append(plan.Added, newPeerPlan(w))
+
+			continue
+		}
+
+		matched[i] = true
+
+		fields := diffPeer(existing[i], w)
+		if len(fields) == 0 {
+			plan.Unchanged++
+
+			continue
+		}
+
+		p := newPeerPlan(w)
+		p.Fields = fields
+		plan.Changed = append(plan.Changed, p)
+	}
+
+	for i, w := range existing {
+		if !matched[i] {
+			plan.Removed = append(plan.Removed, newPeerPlan(w))
+		}
+	}
+
+	byPeerID := func(a, b PeerPlan) int {
+		return cmp.Compare(a.ID, b.ID)
+	}
+
+	slices.SortFunc(plan.Added, byPeerID)
+	slices.SortFunc(plan.Removed, byPeerID)
+	slices.SortFunc(plan.Changed, byPeerID)
+
+	return plan
+}
+
+// Plan returns the changes that Generate would make to the peers, such as
+// which peers would be added or removed, receive new keys, or have values
+// replaced by the Force* options, without changing the configuration.
+func (conf *Configuration) Plan() (*Plan, error) {
+	return conf.PlanWithOptions(GenerateOptions{})
+}
+
+// PlanWithOptions behaves the same as Plan, but compares against the peers in
+// opts.Store instead of conf.Peers if it's set. The store is only read from,
+// and the Sink and ServerWriter of opts are ignored.
+func (conf *Configuration) PlanWithOptions(opts GenerateOptions) (*Plan, error) {
+	// generating happens on a copy, so that conf is left untouched
+	planned := *conf
+	planned.Peers = slices.Clone(conf.Peers)
+	planned.PresharedKeys = slices.Clone(conf.PresharedKeys)
+	planned.GenerationParams.Hubs = slices.Clone(conf.GenerationParams.Hubs)
+	planned.GenerationParams.Reservations = slices.Clone(conf.GenerationParams.Reservations)
+	planned.GenerationParams.ExcludedAddresses = slices.Clone(conf.GenerationParams.ExcludedAddresses)
+
+	if opts.Store != nil {
+		var err error
+
+		planned.Peers, err = opts.Store.Peers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load peers from store: %w", err)
+		}
+
+		planned.PresharedKeys, err = opts.Store.PresharedKeys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load preshared keys from store: %w", err)
+		}
+	}
+
+	existing := slices.Clone(planned.Peers)
+
+	err := planned.GenerateContext(context.Background(), GenerateOptions{Progress: opts.Progress})
+	if err != nil {
+		return nil, err
+	}
+
+	return diffPeers(existing, planned.Peers), nil
+}
@@ -0,0 +1,337 @@
+package gen
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// planIDs returns the ids of the peers in a list of a Plan.
+func planIDs(peers []PeerPlan) []uint {
+	ids := []uint{}
+	for _, p := range peers {
+		ids = append(ids, p.ID)
+	}
+
+	return ids
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, conf *Configuration)
+		added       []uint
+		removed     []uint
+		changed     []uint
+		fields      []FieldChange
+		unchanged   int
+		wantChanges bool
+	}{
+		{
+			name:      "unchanged",
+			added:     []uint{},
+			removed:   []uint{},
+			changed:   []uint{},
+			unchanged: 6,
+		},
+		{
+			name: "added",
+			setup: func(t *testing.T, conf *Configuration) {
+				removePeers(conf, 6)
+			},
+			added:       []uint{6},
+			removed:     []uint{},
+			changed:     []uint{},
+			unchanged:   5,
+			wantChanges: true,
+		},
+		{
+			name: "removed",
+			setup: func(t *testing.T, conf *Configuration) {
+				conf.GenerationParams.MaxPeers = 5
+			},
+			added:       []uint{},
+			removed:     []uint{6},
+			changed:     []uint{},
+			unchanged:   5,
+			wantChanges: true,
+		},
+		{
+			name: "changed",
+			setup: func(t *testing.T, conf *Configuration) {
+				testPeer(t, conf, 3).MTU = 1500
+				conf.GenerationParams.ForceMTU = true
+			},
+			added:       []uint{},
+			removed:     []uint{},
+			changed:     []uint{3},
+			fields:      []FieldChange{{Field: "mtu", From: "1500", To: "1280"}},
+			unchanged:   5,
+			wantChanges: true,
+		},
+	}
+
+	for _, tt := range tests {
+		conf := loadTestNetwork(t)
+		if tt.setup != nil {
+			tt.setup(t, conf)
+		}
+
+		plan, err := conf.Plan()
+		if err != nil {
+			t.Fatalf("%v: failed to plan: %v", tt.name, err)
+		}
+
+		if got := planIDs(plan.Added); !slices.Equal(got, tt.added) {
+			t.Errorf("%v: expected added peers %v, got %v", tt.name, tt.added, got)
+		}
+
+		if got := planIDs(plan.Removed); !slices.Equal(got, tt.removed) {
+			t.Errorf("%v: expected removed peers %v, got %v", tt.name, tt.removed, got)
+		}
+
+		if got := planIDs(plan.Changed); !slices.Equal(got, tt.changed) {
+			t.Errorf("%v: expected changed peers %v, got %v", tt.name, tt.changed, got)
+		}
+
+		if tt.fields != nil && !reflect.DeepEqual(plan.Changed[0].Fields, tt.fields) {
+			t.Errorf("%v: expected fields %v, got %v", tt.name, tt.fields, plan.Changed[0].Fields)
+		}
+
+		if plan.Unchanged != tt.unchanged {
+			t.Errorf("%v: expected %v unchanged peers, got %v", tt.name, tt.unchanged, plan.Unchanged)
+		}
+
+		if plan.HasChanges() != tt.wantChanges {
+			t.Errorf("%v: expected HasChanges to be %v", tt.name, tt.wantChanges)
+		}
+	}
+}
+
+func TestPlanRedactsSecrets(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	// generating sets the configs, so that they're compared as well
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	secrets := []string{}
+	for _, w := range conf.Peers {
+		secrets = append(secrets, w.PrivateKey, w.PreSharedKey, w.Config)
+	}
+
+	conf.GenerationParams.RegenerateKeys = true
+
+	plan, err := conf.Plan()
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+
+	if len(plan.Changed) != len(conf.Peers) {
+		t.Fatalf("expected every peer to change, got %v", planIDs(plan.Changed))
+	}
+
+	redacted := map[string]bool{}
+
+	for _, p := range plan.Changed {
+		for _, f := range p.Fields {
+			switch f.Field {
+			case "privateKey", "preSharedKey", "config":
+				if f.From != Redacted || f.To != Redacted {
+					t.Errorf("peer %v: expected %v to be redacted, got %v & %v", p.ID, f.Field, f.From, f.To)
+				}
+
+				redacted[f.Field] = true
+			case "publicKey":
+				if f.From == Redacted || f.To == Redacted {
+					t.Errorf("peer %v: expected the public key not to be redacted", p.ID)
+				}
+			}
+		}
+	}
+
+	for _, field := range []string{"privateKey", "preSharedKey", "config"} {
+		if !redacted[field] {
+			t.Errorf("expected %v to change", field)
+		}
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("failed to marshal plan: %v", err)
+	}
+
+	for _, s := range secrets {
+		if s != "" && strings.Contains(string(b), s) {
+			t.Fatalf("plan contains a secret: %v", s)
+		}
+	}
+}
+
+func TestDiffPeersMatching(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  WgConfig
+		generated WgConfig
+		added     []uint
+		removed   []uint
+		fields    []FieldChange
+	}{
+		{
+			name:      "by uid",
+			existing:  WgConfig{ID: 1, UID: "a"},
+			generated: WgConfig{ID: 2, UID: "a"},
+			added:     []uint{},
+			removed:   []uint{},
+			fields:    []FieldChange{{Field: "id", From: "1", To: "2"}},
+		},
+		{
+			name:      "by id without a uid",
+			existing:  WgConfig{ID: 1},
+			generated: WgConfig{ID: 1, UID: "a"},
+			added:     []uint{},
+			removed:   []uint{},
+			fields:    []FieldChange{{Field: "uid", From: "", To: "a"}},
+		},
+		{
+			name:      "not by id with a different uid",
+			existing:  WgConfig{ID: 1, UID: "a"},
+			generated: WgConfig{ID: 1, UID: "b"},
+			added:     []uint{1},
+			removed:   []uint{1},
+		},
+	}
+
+	for _, tt := range tests {
+		plan := diffPeers([]WgConfig{tt.existing}, []WgConfig{tt.generated})
+
+		if got := planIDs(plan.Added); !slices.Equal(got, tt.added) {
+			t.Errorf("%v: expected added peers %v, got %v", tt.name, tt.added, got)
+		}
+
+		if got := planIDs(plan.Removed); !slices.Equal(got, tt.removed) {
+			t.Errorf("%v: expected removed peers %v, got %v", tt.name, tt.removed, got)
+		}
+
+		if tt.fields == nil {
+			if len(plan.Changed) > 0 {
+				t.Errorf("%v: expected no changed peers, got %v", tt.name, planIDs(plan.Changed))
+			}
+
+			continue
+		}
+
+		if len(plan.Changed) != 1 || !reflect.DeepEqual(plan.Changed[0].Fields, tt.fields) {
+			t.Errorf("%v: expected fields %v, got %+v", tt.name, tt.fields, plan.Changed)
+		}
+	}
+}
+
+func TestPlanLeavesConfigurationUnchanged(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	conf.GenerationParams.Hubs = []Hub{{IP: "10.0.0.2", Endpoint: "6.6.6.6", AllowedIPs: "10.0.0.2/32"}}
+	conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.5"}}
+	conf.GenerationParams.ExcludedAddresses = []string{"10.0.0.6"}
+	conf.Peers = conf.Peers[:4]
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	conf.GenerationParams.RegenerateKeys = true
+	conf.GenerationParams.ForceName = true
+	conf.GenerationParams.Name = "renamed"
+
+	// the slices are copied too, since the form itself is only copied
+	// shallowly by assigning it
+	form := conf.GenerationParams
+	hubs := slices.Clone(form.Hubs)
+	reservations := slices.Clone(form.Reservations)
+	excluded := slices.Clone(form.ExcludedAddresses)
+	peers := slices.Clone(conf.Peers)
+	keys := slices.Clone(conf.PresharedKeys)
+	psks := conf.psks
+
+	plan, err := conf.Plan()
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+
+	if !plan.HasChanges() {
+		t.Fatal("expected the plan to have changes")
+	}
+
+	if !reflect.DeepEqual(conf.GenerationParams, form) {
+		t.Error("the generation form was changed by planning")
+	}
+
+	if !slices.Equal(conf.GenerationParams.Hubs, hubs) ||
+		!slices.Equal(conf.GenerationParams.Reservations, reservations) ||
+		!slices.Equal(conf.GenerationParams.ExcludedAddresses, excluded) {
+		t.Error("the hubs, reservations or excluded addresses were changed by planning")
+	}
+
+	if !reflect.DeepEqual(conf.Peers, peers) {
+		t.Error("the peers were changed by planning")
+	}
+
+	if !reflect.DeepEqual(conf.PresharedKeys, keys) || conf.psks != psks {
+		t.Error("the preshared keys were changed by planning")
+	}
+}
+
+func TestPlanStore(t *testing.T) {
+	store := newTestStore(t)
+
+	conf := &Configuration{
+		GenerationParams: GenerationForm{
+			CIDR:         "10.0.0.0/29",
+			Server:       "10.0.0.1",
+			Endpoint:     "5.5.5.5",
+			EndpointPort: 51820,
+		},
+	}
+
+	err := conf.GenerateWithOptions(GenerateOptions{Store: store})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	before := readStore(t, store)
+
+	conf.GenerationParams.ForceName = true
+	conf.GenerationParams.Name = "renamed"
+
+	plan, err := conf.PlanWithOptions(GenerateOptions{Store: store})
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+
+	// the peers are compared with the store's, since conf.Peers is empty
+	if len(plan.Changed) != len(before.peers) || len(plan.Added) != 0 {
+		t.Errorf("expected every peer in the store to change, got %+v", plan)
+	}
+
+	for _, p := range plan.Changed {
+		want := []FieldChange{{Field: "name", From: "", To: "renamed"}}
+		if !reflect.DeepEqual(p.Fields, want) {
+			t.Errorf("peer %v: expected fields %v, got %v", p.ID, want, p.Fields)
+		}
+	}
+
+	after := readStore(t, store)
+
+	if !reflect.DeepEqual(before, after) {
+		t.Error("the store was changed by planning")
+	}
+
+	if len(conf.Peers) != 0 {
+		t.Errorf("expected conf.Peers to stay empty, got %v peers", len(conf.Peers))
+	}
+}
@@ -0,0 +1,150 @@
+package gen
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Phase identifies a stage of the generation process that progress is being
+// reported for.
+type Phase string
+
+const (
+	// PhasePreProcessing covers walking the CIDR and collecting every IP
+	// address that needs a peer.
+	PhasePreProcessing Phase = "pre-processing"
+	// PhaseConfiguring covers generating keys and configs for every peer.
+	PhaseConfiguring Phase = "configuring"
+	// PhasePostProcessing covers assembling the final list of peers.
+	PhasePostProcessing Phase = "post-processing"
+)
+
+// ProgressReporter receives progress updates while a configuration is being
+// generated. Increment may be called concurrently from multiple goroutines, so
+// implementations must be safe for concurrent use.
+type ProgressReporter interface {
+	// Start is called when a phase begins, along with the estimated amount of
+	// work that the phase will perform.
+	Start(phase Phase, total int)
+	// Increment is called each time a single unit of work completes.
+	Increment(phase Phase)
+	// SetTotal is called when the total amount of work for a phase becomes
+	// more accurately known than the estimate passed to Start.
+	SetTotal(phase Phase, total int)
+	// Done is called when a phase has completed.
+	Done(phase Phase)
+}
+
+// NopProgressReporter discards all progress updates.
+type NopProgressReporter struct{}
+
+func (NopProgressReporter) Start(Phase, int)    {}
+func (NopProgressReporter) Increment(Phase)     {}
+func (NopProgressReporter) SetTotal(Phase, int) {}
+func (NopProgressReporter) Done(Phase)          {}
+
+// TextProgressReporter writes a line to W whenever a phase starts, its total
+// changes, or it completes. Individual increments aren't written.
+type TextProgressReporter struct {
+	W io.Writer
+}
+
+// NewTextProgressReporter returns a TextProgressReporter that writes to w.
+func NewTextProgressReporter(w io.Writer) *TextProgressReporter {
+	return &TextProgressReporter{W: w}
+}
+
+func (r *TextProgressReporter) Start(phase Phase, total int) {
+	fmt.Fprintf(r.W, "%v: started, %v estimated\n", phase, total)
+}
+
+func (r *TextProgressReporter) Increment(Phase) {}
+
+func (r *TextProgressReporter) SetTotal(phase Phase, total int) {
+	fmt.Fprintf(r.W, "%v: %v in total\n", phase, total)
+}
+
+func (r *TextProgressReporter) Done(phase Phase) {
+	fmt.Fprintf(r.W, "%v: done\n", phase)
+}
+
+// ProgressEventKind describes which ProgressReporter method produced a
+// ProgressEvent.
+type ProgressEventKind string
+
+const (
+	ProgressStart     ProgressEventKind = "start"
+	ProgressIncrement ProgressEventKind = "increment"
+	ProgressSetTotal  ProgressEventKind = "setTotal"
+	ProgressDone      ProgressEventKind = "done"
+)
+
+// ProgressEvent is a single progress update sent by a ChannelProgressReporter.
+type ProgressEvent struct {
+	Phase Phase
+	Kind  ProgressEventKind
+	// Total is only set for ProgressStart and ProgressSetTotal events.
+	Total int
+}
+
+// ChannelProgressReporter sends every progress update to a channel.
+//
+// Sends block until the update is received, and Increment is called by every
+// generation worker, so a receiver that stops draining the channel stalls
+// generation entirely. Either keep receiving until generation has returned,
+// or set Ctx (see NewChannelProgressReporterContext) and cancel it when the
+// receiver stops, in which case any remaining updates are dropped instead.
+// Passing the same context to GenerateContext also stops the generation.
+type ChannelProgressReporter struct {
+	C chan<- ProgressEvent
+	// Ctx, if set, abandons any send that is still blocked once Ctx is done,
+	// and drops every update after that.
+	Ctx context.Context
+}
+
+// NewChannelProgressReporter returns a ChannelProgressReporter that sends
+// progress updates to c. Every send blocks until it is received.
+func NewChannelProgressReporter(c chan<- ProgressEvent) *ChannelProgressReporter {
+	return &ChannelProgressReporter{C: c}
+}
+
+// NewChannelProgressReporterContext returns a ChannelProgressReporter that
+// sends progress updates to c until ctx is done.
+func NewChannelProgressReporterContext(ctx context.Context, c chan<- ProgressEvent) *ChannelProgressReporter {
+	return &ChannelProgressReporter{C: c, Ctx: ctx}
+}
+
+// send sends ev to r.C, giving up once r.Ctx is done.
+func (r *ChannelProgressReporter) send(ev ProgressEvent) {
+	if r.Ctx == nil {
+		r.C <- ev
+
+		return
+	}
+
+	if r.Ctx.Err() != nil {
+		return
+	}
+
+	select {
+	case r.C <- ev:
+	case <-r.Ctx.Done():
+	}
+}
+
+func (r *ChannelProgressReporter) Start(phase Phase, total int) {
+	r.send(ProgressEvent{Phase: phase, Kind: ProgressStart, Total: total})
+}
+
+func (r *ChannelProgressReporter) Increment(phase Phase) {
+	r.send(ProgressEvent{Phase: phase, Kind: ProgressIncrement})
+}
+
+func (r *ChannelProgressReporter) SetTotal(phase Phase, total int) {
+	r.send(ProgressEvent{Phase: phase, Kind: ProgressSetTotal, Total: total})
+}
+
+func (r *ChannelProgressReporter) Done(phase Phase) {
+	r.send(ProgressEvent{Phase: phase, Kind: ProgressDone})
+}
@@ -0,0 +1,88 @@
+package gen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChannelProgressReporterContext(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// only the first event is received, so every later send blocks until ctx
+	// is cancelled
+	events := make(chan ProgressEvent)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- conf.GenerateContext(ctx, GenerateOptions{
+			Progress: NewChannelProgressReporterContext(ctx, events),
+		})
+	}()
+
+	// receiving the first event means generation has started, and the next
+	// send has nothing to receive it
+	select {
+	case <-events:
+	case err := <-done:
+		t.Fatalf("generation returned before sending any progress: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation never sent any progress")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation stalled after the context was cancelled")
+	}
+}
+
+// recordingReporter counts the increments of each phase.
+type recordingReporter struct {
+	NopProgressReporter
+	increments map[Phase]int
+}
+
+func (r *recordingReporter) Increment(phase Phase) {
+	r.increments[phase]++
+}
+
+func TestSparseSlotsContext(t *testing.T) {
+	conf := loadTestNetwork(t)
+	conf.GenerationParams.Sparse = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	peers := conf.Peers
+
+	err := conf.GenerateContext(ctx, GenerateOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if &conf.Peers[0] != &peers[0] {
+		t.Error("peers were replaced by a cancelled run")
+	}
+
+	progress := &recordingReporter{increments: map[Phase]int{}}
+
+	err = conf.GenerateWithOptions(GenerateOptions{Progress: progress})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	if got := progress.increments[PhasePreProcessing]; got != len(peers) {
+		t.Errorf("expected %v pre-processing increments, got %v", len(peers), got)
+	}
+}
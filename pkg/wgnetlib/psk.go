@@ -0,0 +1,143 @@
+package gen
+
+import (
+	"sort"
+	"sync"
+)
+
+// PresharedKey is the preshared key used between a pair of peers.
+type PresharedKey struct {
+	// Peers are the IDs of the pair of peers, lowest first.
+	Peers [2]uint `yaml:"peers" json:"peers" toml:"peers"`
+	Key   string  `yaml:"key" json:"key" toml:"key"`
+}
+
+// pairID identifies an unordered pair of peers, lowest ID first.
+type pairID [2]uint
+
+func newPairID(a, b uint) pairID {
+	if b < a {
+		a, b = b, a
+	}
+
+	return pairID{a, b}
+}
+
+// pskStore holds the preshared key of every pair of peers while generating.
+// It's safe for concurrent use.
+type pskStore struct {
+	mutex sync.Mutex
+	keys  map[pairID]string
+	// used contains the pairs whose key was requested during this run, which
+	// are the only ones that are kept afterwards
+	used map[pairID]bool
+	// rekeyed contains the peers that received new keys during this run, and
+	// therefore need new preshared keys with every other peer as well
+	rekeyed map[uint]bool
+	// migrate is set if the configuration predates per-pair keys, in which
+	// case pairs are seeded with the key they were previously using
+	migrate bool
+}
+
+func newPSKStore(keys []PresharedKey, migrate bool) *pskStore {
+	s := &pskStore{
+		keys:    make(map[pairID]string, len(keys)),
+		used:    make(map[pairID]bool, len(keys)),
+		rekeyed: make(map[uint]bool),
+		migrate: migrate,
+	}
+
+	for _, k := range keys {
+		s.keys[newPairID(k.Peers[0], k.Peers[1])] = k.Key
+	}
+
+	return s
+}
+
+// rekey discards the preshared keys of every pair that includes id.
+func (s *pskStore) rekey(id uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rekeyed[id] = true
+}
+
+// get returns the preshared key for the pair of peers a & b, generating one if
+// needed. legacy is the key that the pair used before per-pair keys existed,
+// which is only used when migrating.
+func (s *pskStore) get(a, b uint, legacy string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := newPairID(a, b)
+	rekeyed := s.rekeyed[a] || s.rekeyed[b]
+
+	key, ok := s.keys[id]
+	if ok && (s.used[id] || !rekeyed) {
+		s.used[id] = true
+
+		return key
+	}
+
+	key = ""
+	if s.migrate && !rekeyed {
+		key = legacy
+	}
+
+	if key == "" {
+		key = GeneratePreSharedKey()
+	}
+
+	s.keys[id] = key
+	s.used[id] = true
+
+	return key
+}
+
+// snapshot returns the keys of every pair that was used, ordered by pair.
+func (s *pskStore) snapshot() []PresharedKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make([]PresharedKey, 0, len(s.used))
+
+	for id := range s.used {
+		result = append(result, PresharedKey{Peers: id, Key: s.keys[id]})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Peers[0] != result[j].Peers[0] {
+			return result[i].Peers[0] < result[j].Peers[0]
+		}
+
+		return result[i].Peers[1] < result[j].Peers[1]
+	})
+
+	return result
+}
+
+// loadPresharedKeys prepares the preshared keys for a run. If regenerate is
+// set, every pair receives a new key. Configurations that already have peers
+// but no per-pair keys were generated before per-pair keys existed, so each
+// pair is seeded with the key it was previously using in order to keep
+// existing deployments working.
+func (conf *Configuration) loadPresharedKeys(existing []WgConfig, regenerate bool) {
+	keys := conf.PresharedKeys
+	if regenerate {
+		keys = nil
+	}
+
+	migrate := !regenerate && len(conf.PresharedKeys) == 0 && len(existing) > 0
+
+	conf.psks = newPSKStore(keys, migrate)
+}
+
+// pairKey returns the preshared key for the pair of peers a & b. See
+// pskStore.get.
+func (conf *Configuration) pairKey(a, b uint, legacy string) string {
+	if conf.psks == nil {
+		conf.loadPresharedKeys(nil, false)
+	}
+
+	return conf.psks.get(a, b, legacy)
+}
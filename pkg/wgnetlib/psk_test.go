@@ -0,0 +1,111 @@
+package gen
+
+import (
+	"testing"
+)
+
+// pairKeys indexes the configuration's preshared keys by pair.
+func pairKeys(conf *Configuration) map[pairID]string {
+	keys := make(map[pairID]string, len(conf.PresharedKeys))
+
+	for _, k := range conf.PresharedKeys {
+		keys[newPairID(k.Peers[0], k.Peers[1])] = k.Key
+	}
+
+	return keys
+}
+
+// regenerate saves & reloads the configuration, the same as a subsequent run,
+// and then generates it again.
+func regenerate(t *testing.T, conf *Configuration) *Configuration {
+	t.Helper()
+
+	b, err := conf.Marshal(FormatYAML)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	next := &Configuration{}
+
+	err = next.Unmarshal(b, FormatYAML)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	err = next.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	return next
+}
+
+func TestPresharedKeysPersist(t *testing.T) {
+	conf := loadTestNetwork(t)
+	want := pairKeys(conf)
+
+	got := pairKeys(regenerate(t, regenerate(t, conf)))
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %v preshared keys, got %v", len(want), len(got))
+	}
+
+	for id, key := range want {
+		if got[id] != key {
+			t.Errorf("preshared key for %v changed between runs", id)
+		}
+	}
+}
+
+func TestPresharedKeysRekeyedPeer(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	// the server & hub are paired with each other and with every client
+	conf.GenerationParams.Hubs = []Hub{{IP: "10.0.0.2", Endpoint: "6.6.6.6"}}
+	conf = regenerate(t, conf)
+	before := pairKeys(conf)
+
+	if _, ok := before[newPairID(2, 4)]; !ok {
+		t.Fatal("expected the hub to be paired with every client")
+	}
+
+	// clearing a peer's keys is the same as a user removing them by hand
+	client := testPeer(t, conf, 3)
+	client.PrivateKey = ""
+	client.PublicKey = ""
+
+	after := pairKeys(regenerate(t, conf))
+
+	if len(after) != len(before) {
+		t.Fatalf("expected %v preshared keys, got %v", len(before), len(after))
+	}
+
+	for id, key := range before {
+		rekeyed := id[0] == 3 || id[1] == 3
+
+		switch {
+		case rekeyed && after[id] == key:
+			t.Errorf("preshared key for %v was kept after peer 3 was re-keyed", id)
+		case !rekeyed && after[id] != key:
+			t.Errorf("preshared key for %v changed, but neither peer was re-keyed", id)
+		}
+	}
+}
+
+func TestPresharedKeysRegenerateKeys(t *testing.T) {
+	conf := loadTestNetwork(t)
+	before := pairKeys(conf)
+
+	conf.GenerationParams.RegenerateKeys = true
+	after := pairKeys(regenerate(t, conf))
+
+	if len(after) != len(before) {
+		t.Fatalf("expected %v preshared keys, got %v", len(before), len(after))
+	}
+
+	for id, key := range before {
+		if after[id] == key {
+			t.Errorf("preshared key for %v was kept by RegenerateKeys", id)
+		}
+	}
+}
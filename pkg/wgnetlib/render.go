@@ -0,0 +1,453 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// DefaultClientTemplate is the text/template used to render each client's
+// config when GenerationForm.ClientTemplate is empty. It's executed with a
+// ClientTemplateData. Lines whose value is empty or zero are left out.
+const DefaultClientTemplate = `[Interface]
+{{- with trim .Peer.Extra}}
+{{.}}
+{{- end}}
+PrivateKey = {{.PrivateKey}}
+Address = {{.Address}}
+{{- with .Peer.DNS}}
+DNS = {{.}}
+{{- end}}
+{{- with .Peer.MTU}}
+MTU = {{.}}
+{{- end}}
+
+[Peer]
+PublicKey = {{.Server.PublicKey}}
+{{- with .PresharedKey}}
+PresharedKey = {{.}}
+{{- end}}
+{{- with .Endpoint}}
+Endpoint = {{.}}
+{{- end}}
+AllowedIPs = {{.AllowedIPs}}
+{{- with .Peer.PersistentKeepAlive}}
+PersistentKeepAlive = {{.}}
+{{- end}}
+{{- range .Hubs}}
+
+[Peer]
+PublicKey = {{.Peer.PublicKey}}
+{{- with .PresharedKey}}
+PresharedKey = {{.}}
+{{- end}}
+{{- with .Endpoint}}
+Endpoint = {{.}}
+{{- end}}
+AllowedIPs = {{.AllowedIPs}}
+{{- with $.Peer.PersistentKeepAlive}}
+PersistentKeepAlive = {{.}}
+{{- end}}
+{{- end}}
+`
+
+// DefaultServerTemplate is the text/template used to render the [Interface]
+// section of the server's config, along with a [Peer] section for each of the
+// other hubs, when GenerationForm.ServerTemplate is empty. It's also used for
+// the hubs' configs. It's executed with a ServerTemplateData, and the [Peer]
+// sections for the clients are appended to its output.
+const DefaultServerTemplate = `[Interface]
+{{- with trim .Server.Extra}}
+{{.}}
+{{- end}}
+PrivateKey = {{.Server.PrivateKey}}
+Address = {{.Address}}
+{{- with .Server.EndpointPort}}
+ListenPort = {{.}}
+{{- end}}
+{{- with .Server.DNS}}
+DNS = {{.}}
+{{- end}}
+{{- with .Server.MTU}}
+MTU = {{.}}
+{{- end}}
+{{- with .PreUp}}
+PreUp = {{.}}
+{{- end}}
+{{- with .PostUp}}
+PostUp = {{.}}
+{{- end}}
+{{- with .PreDown}}
+PreDown = {{.}}
+{{- end}}
+{{- with .PostDown}}
+PostDown = {{.}}
+{{- end}}
+{{- range .Hubs}}
+
+[Peer]
+PublicKey = {{.Peer.PublicKey}}
+{{- with .PresharedKey}}
+PresharedKey = {{.}}
+{{- end}}
+{{- with .Endpoint}}
+Endpoint = {{.}}
+{{- end}}
+AllowedIPs = {{.AllowedIPs}}
+{{- end}}
+
+`
+
+// DefaultServerPeerTemplate is the text/template used to render each [Peer]
+// section of the server's config when GenerationForm.ServerPeerTemplate is
+// empty. It's executed with a ServerPeerTemplateData.
+const DefaultServerPeerTemplate = `[Peer]
+PublicKey = {{.Peer.PublicKey}}
+AllowedIPs = {{.AllowedIPs}}
+{{- with .PresharedKey}}
+PresharedKey = {{.}}
+{{- end}}
+
+`
+
+// DefaultMeshTemplate is the text/template used to render each peer's config
+// in a mesh when GenerationForm.MeshTemplate is empty. It's executed with a
+// MeshTemplateData.
+const DefaultMeshTemplate = `[Interface]
+{{- with trim .Peer.Extra}}
+{{.}}
+{{- end}}
+PrivateKey = {{.PrivateKey}}
+Address = {{.Address}}
+{{- with .ListenPort}}
+ListenPort = {{.}}
+{{- end}}
+{{- with .Peer.DNS}}
+DNS = {{.}}
+{{- end}}
+{{- with .Peer.MTU}}
+MTU = {{.}}
+{{- end}}
+{{- range .Peers}}
+
+[Peer]
+PublicKey = {{.Peer.PublicKey}}
+{{- with .PresharedKey}}
+PresharedKey = {{.}}
+{{- end}}
+{{- with .Endpoint}}
+Endpoint = {{.}}
+{{- end}}
+AllowedIPs = {{.AllowedIPs}}
+{{- with $.Peer.PersistentKeepAlive}}
+PersistentKeepAlive = {{.}}
+{{- end}}
+{{- end}}
+`
+
+// templateFuncs are the functions available to every template, in addition to
+// the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"trim":     strings.TrimSpace,
+	"join":     strings.Join,
+	"replace":  strings.ReplaceAll,
+	"endpoint": FormatEndpoint,
+}
+
+// ClientTemplateData is the data that the client template is executed with.
+type ClientTemplateData struct {
+	// Peer is the client that the config is being rendered for.
+	Peer WgConfig
+	// Server is the server that the client connects to.
+	Server WgConfig
+	// PrivateKey is the client's private key, or PrivateKeyPlaceholder if the
+	// client is external.
+	PrivateKey string
+	// Params is the GenerationForm that the configuration was generated with.
+	Params GenerationForm
+	// Network is the CIDR that the peers are allocated from.
+	Network string
+	// SecondaryNetwork is the secondary CIDR, if any.
+	SecondaryNetwork string
+	// Address is the value of the client's Address line, including its
+	// secondary address if it has one.
+	Address string
+	// Endpoint is the client's endpoint as host:port, or empty if the client
+	// has no endpoint.
+	Endpoint string
+	// PresharedKey is the key shared between the client and the server.
+	PresharedKey string
+	// AllowedIPs is the value of the AllowedIPs line of the server's [Peer]
+	// section, which is the client's AllowedIPs along with the subnets routed
+	// through the server & the other clients.
+	AllowedIPs string
+	// Hubs are the [Peer] sections for each of the hubs, not including the
+	// server.
+	Hubs []HubPeer
+}
+
+// ServerTemplateData is the data that the server template is executed with.
+type ServerTemplateData struct {
+	// Server is the server peer, or the hub whose config is being rendered.
+	Server WgConfig
+	// Params is the GenerationForm that the configuration was generated with.
+	Params GenerationForm
+	// Network is the CIDR that the peers are allocated from.
+	Network string
+	// SecondaryNetwork is the secondary CIDR, if any.
+	SecondaryNetwork string
+	// Address is the value of the server's Address line, including its
+	// secondary address if it has one.
+	Address string
+	// PreUp, PostUp, PreDown and PostDown are the firewall commands for the
+	// server, as determined by GenerationForm.Firewall.
+	PreUp    string
+	PostUp   string
+	PreDown  string
+	PostDown string
+	// Hubs are the [Peer] sections for each of the other hubs, including the
+	// primary server when rendering a hub's config.
+	Hubs []HubPeer
+}
+
+// ServerPeerTemplateData is the data that the server peer template is
+// executed with.
+type ServerPeerTemplateData struct {
+	// Peer is the client that the [Peer] section is being rendered for.
+	Peer WgConfig
+	// Server is the server or hub whose config the [Peer] section is part of.
+	Server WgConfig
+	// Params is the GenerationForm that the configuration was generated with.
+	Params GenerationForm
+	// Network is the CIDR that the peers are allocated from.
+	Network string
+	// SecondaryNetwork is the secondary CIDR, if any.
+	SecondaryNetwork string
+	// AllowedIPs is the value of the [Peer] section's AllowedIPs line, which
+	// is the client's own address(es).
+	AllowedIPs string
+	// PresharedKey is the key shared between the client and Server.
+	PresharedKey string
+}
+
+// MeshTemplateData is the data that the mesh template is executed with.
+type MeshTemplateData struct {
+	// Peer is the mesh member that the config is being rendered for.
+	Peer WgConfig
+	// PrivateKey is the member's private key, or PrivateKeyPlaceholder if the
+	// member is external.
+	PrivateKey string
+	// Params is the GenerationForm that the configuration was generated with.
+	Params GenerationForm
+	// Network is the CIDR that the peers are allocated from.
+	Network string
+	// SecondaryNetwork is the secondary CIDR, if any.
+	SecondaryNetwork string
+	// Address is the value of the peer's Address line, including its
+	// secondary address if it has one.
+	Address string
+	// ListenPort is the peer's EndpointPort if it has an endpoint, otherwise
+	// 0.
+	ListenPort uint16
+	// Peers are the [Peer] sections for each of the other members.
+	Peers []HubPeer
+}
+
+// renderTemplates holds the parsed templates used while generating.
+type renderTemplates struct {
+	client     *template.Template
+	server     *template.Template
+	serverPeer *template.Template
+	mesh       *template.Template
+}
+
+// defaultTemplates are the parsed default templates.
+var defaultTemplates = renderTemplates{
+	client:     template.Must(template.New("client").Funcs(templateFuncs).Parse(DefaultClientTemplate)),
+	server:     template.Must(template.New("server").Funcs(templateFuncs).Parse(DefaultServerTemplate)),
+	serverPeer: template.Must(template.New("serverPeer").Funcs(templateFuncs).Parse(DefaultServerPeerTemplate)),
+	mesh:       template.Must(template.New("mesh").Funcs(templateFuncs).Parse(DefaultMeshTemplate)),
+}
+
+// parseTemplate parses the custom template text, or returns def if text is
+// empty.
+func parseTemplate(name, text string, def *template.Template) (*template.Template, error) {
+	if text == "" {
+		return def, nil
+	}
+
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v template: %w", name, err)
+	}
+
+	return t, nil
+}
+
+// parseTemplates parses the custom templates from the GenerationForm, falling
+// back to the default templates for any that aren't set.
+func (conf *Configuration) parseTemplates() error {
+	client, err := parseTemplate("client", conf.GenerationParams.ClientTemplate, defaultTemplates.client)
+	if err != nil {
+		return err
+	}
+
+	server, err := parseTemplate("server", conf.GenerationParams.ServerTemplate, defaultTemplates.server)
+	if err != nil {
+		return err
+	}
+
+	serverPeer, err := parseTemplate("serverPeer", conf.GenerationParams.ServerPeerTemplate, defaultTemplates.serverPeer)
+	if err != nil {
+		return err
+	}
+
+	mesh, err := parseTemplate("mesh", conf.GenerationParams.MeshTemplate, defaultTemplates.mesh)
+	if err != nil {
+		return err
+	}
+
+	conf.templates = &renderTemplates{
+		client:     client,
+		server:     server,
+		serverPeer: serverPeer,
+		mesh:       mesh,
+	}
+
+	return nil
+}
+
+// getTemplates returns the parsed templates, parsing them first if needed.
+func (conf *Configuration) getTemplates() (*renderTemplates, error) {
+	if conf.templates == nil {
+		err := conf.parseTemplates()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return conf.templates, nil
+}
+
+// networkStrings returns the primary & secondary CIDRs for template data.
+func (conf *Configuration) networkStrings() (string, string) {
+	network := ""
+	if conf.network != nil {
+		network = conf.network.String()
+	}
+
+	secondaryNetwork := ""
+	if conf.secondaryNetwork != nil {
+		secondaryNetwork = conf.secondaryNetwork.String()
+	}
+
+	return network, secondaryNetwork
+}
+
+// bufferPool holds the buffers that templates are executed into, since a
+// config is rendered for every peer and reusing the buffers saves allocating
+// them each time.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// execute runs t with data and returns the output.
+func execute(t *template.Template, data any) (string, error) {
+	b := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(b)
+
+	b.Reset()
+
+	err := t.Execute(b, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render %v template: %w", t.Name(), err)
+	}
+
+	return b.String(), nil
+}
+
+// clientTemplateData builds the data for rendering the client w.
+func clientTemplateData(w WgConfig, server WgConfig) ClientTemplateData {
+	endpoint := ""
+	if w.Endpoint != "" {
+		endpoint = FormatEndpoint(w.Endpoint, w.EndpointPort)
+	}
+
+	return ClientTemplateData{
+		Peer:         w,
+		Server:       server,
+		PrivateKey:   w.privateKey(),
+		Address:      w.hostAddresses(),
+		Endpoint:     endpoint,
+		PresharedKey: w.PreSharedKey,
+		AllowedIPs:   w.AllowedIPs,
+	}
+}
+
+// renderClientConfig renders the Wireguard configuration of the client peer
+// w, which connects to server and each of the hubs.
+func (conf *Configuration) renderClientConfig(w WgConfig, server WgConfig, hubs []WgConfig) (string, error) {
+	templates, err := conf.getTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	data := clientTemplateData(w, server)
+	data.Params = conf.GenerationParams
+	data.Hubs = conf.clientHubPeers(w, hubs)
+	data.AllowedIPs = conf.clientAllowedIPs(w)
+	data.Network, data.SecondaryNetwork = conf.networkStrings()
+
+	return execute(templates.client, data)
+}
+
+// renderServerInterface renders the [Interface] section of the server or hub
+// w, along with the [Peer] sections for the other hubs. This precedes all of
+// the [Peer] sections for the clients.
+func (conf *Configuration) renderServerInterface(w WgConfig, address string, cmds firewallCommands, hubs []HubPeer) (string, error) {
+	templates, err := conf.getTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	data := ServerTemplateData{
+		Server:  w,
+		Params:  conf.GenerationParams,
+		Address: address,
+		Hubs:    hubs,
+	}
+	data.PreUp, data.PostUp, data.PreDown, data.PostDown = cmds.joined()
+	data.Network, data.SecondaryNetwork = conf.networkStrings()
+
+	return execute(templates.server, data)
+}
+
+// renderServerPeer renders the [Peer] section that the config of the server
+// or hub node needs in order to accept connections from w.
+func (conf *Configuration) renderServerPeer(node, w WgConfig) (string, error) {
+	return conf.renderServerPeerWithKey(node, w, conf.pairKey(node.ID, w.ID, w.PreSharedKey))
+}
+
+// renderServerPeerWithKey is the same as renderServerPeer, but uses the given
+// preshared key instead of the one from the preshared key store.
+func (conf *Configuration) renderServerPeerWithKey(node, w WgConfig, psk string) (string, error) {
+	templates, err := conf.getTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	data := ServerPeerTemplateData{
+		Peer:         w,
+		Server:       node,
+		Params:       conf.GenerationParams,
+		AllowedIPs:   w.routedAddresses(),
+		PresharedKey: psk,
+	}
+	data.Network, data.SecondaryNetwork = conf.networkStrings()
+
+	return execute(templates.serverPeer, data)
+}
@@ -0,0 +1,304 @@
+package gen
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// loadTestNetwork loads testdata/network.yml, a /29 network whose keys are
+// fixed so that the rendered configs are the same on every run.
+func loadTestNetwork(t *testing.T) *Configuration {
+	t.Helper()
+
+	conf := &Configuration{}
+
+	err := conf.Load(filepath.Join("testdata", "network.yml"))
+	if err != nil {
+		t.Fatalf("failed to load test network: %v", err)
+	}
+
+	return conf
+}
+
+// testPeer returns a pointer to the peer with the given id.
+func testPeer(t *testing.T, conf *Configuration, id uint) *WgConfig {
+	t.Helper()
+
+	for i := range conf.Peers {
+		if conf.Peers[i].ID == id {
+			return &conf.Peers[i]
+		}
+	}
+
+	t.Fatalf("no peer found with id %v", id)
+
+	return nil
+}
+
+// assertGolden compares got with the golden file testdata/name, or replaces
+// the golden file if -update is set.
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+
+	if *update {
+		err := os.WriteFile(path, []byte(got), 0o600)
+		if err != nil {
+			t.Fatalf("failed to update %v: %v", path, err)
+		}
+
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", path, err)
+	}
+
+	if got != string(want) {
+		t.Errorf("%v doesn't match the golden file, got:\n%v\nwant:\n%v", name, got, string(want))
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	got, err := testPeer(t, conf, 2).GenerateConfig(*testPeer(t, conf, 1))
+	if err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+
+	assertGolden(t, "client.conf", got)
+}
+
+func TestGenerateGolden(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	assertGolden(t, "server.conf", testPeer(t, conf, 1).Config)
+	assertGolden(t, "client.conf", testPeer(t, conf, 2).Config)
+}
+
+func TestGenerateEditedPeer(t *testing.T) {
+	conf := loadTestNetwork(t)
+
+	// edit the peers the same way as a user editing the saved yaml
+	server := testPeer(t, conf, 1)
+	server.EndpointPort = 51999
+	server.MTU = 1400
+
+	client := testPeer(t, conf, 2)
+	client.PersistentKeepAlive = 10
+	client.MTU = 1420
+	client.DNS = "1.1.1.1"
+	client.AllowedIPs = "10.0.0.0/29"
+	client.Endpoint = "vpn.example.com"
+	client.EndpointPort = 51999
+
+	b, err := conf.Marshal(FormatYAML)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	edited := &Configuration{}
+
+	err = edited.Unmarshal(b, FormatYAML)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	err = edited.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	assertGolden(t, "server-edited.conf", testPeer(t, edited, 1).Config)
+	assertGolden(t, "client-edited.conf", testPeer(t, edited, 2).Config)
+}
+
+func TestFirewallGolden(t *testing.T) {
+	firewalls := []Firewall{
+		FirewallIPTables,
+		FirewallIP6Tables,
+		FirewallNFTables,
+		FirewallFirewalld,
+		FirewallNone,
+		FirewallCustom,
+	}
+
+	for _, firewall := range firewalls {
+		for _, dualStack := range []bool{false, true} {
+			conf := loadTestNetwork(t)
+			conf.GenerationParams.Firewall = firewall
+			conf.GenerationParams.PreUp = "echo pre-up %i"
+			conf.GenerationParams.PostUp = "echo post-up %i"
+			conf.GenerationParams.PostDown = "echo post-down %i"
+
+			name := fmt.Sprintf("firewall-%v.conf", firewall)
+
+			if dualStack {
+				conf.GenerationParams.SecondaryCIDR = "fd00::/120"
+				name = fmt.Sprintf("firewall-%v-dual-stack.conf", firewall)
+			}
+
+			err := conf.GenerateWithOptions(GenerateOptions{})
+
+			// ip6tables has nothing to do without an ipv6 network
+			if firewall == FirewallIP6Tables && !dualStack {
+				if err == nil || !strings.Contains(err.Error(), "the ip6tables firewall requires an ipv6 cidr") {
+					t.Errorf("%v: expected an ipv4 network to be rejected, got %v", name, err)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%v: failed to generate: %v", name, err)
+			}
+
+			// only the server's [Interface] section depends on the firewall
+			iface, _, _ := strings.Cut(testPeer(t, conf, 1).Config, "\n\n")
+
+			assertGolden(t, name, iface+"\n")
+		}
+	}
+}
+
+// customTemplates add keys that the default templates don't have, and use
+// the rest of the template data.
+var customTemplates = GenerationForm{
+	ClientTemplate: `# {{.Peer.ID}} in {{.Network}} ({{.Params.CIDR}})
+[Interface]
+PrivateKey = {{.PrivateKey}}
+Address = {{.Address}}
+Table = off
+
+[Peer]
+PublicKey = {{.Server.PublicKey}}
+PresharedKey = {{.PresharedKey}}
+Endpoint = {{endpoint .Params.Endpoint .Params.EndpointPort}}
+AllowedIPs = {{.AllowedIPs}}
+`,
+	ServerTemplate: `# {{.Network}} via {{.Params.ServerInterface}}
+[Interface]
+PrivateKey = {{.Server.PrivateKey}}
+Address = {{.Address}}
+ListenPort = {{.Server.EndpointPort}}
+FwMark = 0xca6c
+Table = 1234
+`,
+	ServerPeerTemplate: `
+[Peer]
+# {{.Peer.ID}} in {{.Network}}
+PublicKey = {{.Peer.PublicKey}}
+PresharedKey = {{.PresharedKey}}
+AllowedIPs = {{.AllowedIPs}}
+`,
+	MeshTemplate: `# {{.Peer.ID}} in {{.Network}}
+[Interface]
+PrivateKey = {{.PrivateKey}}
+Address = {{.Address}}
+Table = off
+{{- range .Peers}}
+
+[Peer]
+PublicKey = {{.Peer.PublicKey}}
+AllowedIPs = {{.AllowedIPs}}
+{{- end}}
+`,
+}
+
+func TestCustomTemplatesGolden(t *testing.T) {
+	conf := loadTestNetwork(t)
+	conf.GenerationParams.ClientTemplate = customTemplates.ClientTemplate
+	conf.GenerationParams.ServerTemplate = customTemplates.ServerTemplate
+	conf.GenerationParams.ServerPeerTemplate = customTemplates.ServerPeerTemplate
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	assertGolden(t, "custom-server.conf", testPeer(t, conf, 1).Config)
+	assertGolden(t, "custom-client.conf", testPeer(t, conf, 2).Config)
+
+	mesh := loadTestNetwork(t)
+	mesh.GenerationParams.Topology = TopologyMesh
+	mesh.GenerationParams.MeshTemplate = customTemplates.MeshTemplate
+
+	err = mesh.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate mesh: %v", err)
+	}
+
+	assertGolden(t, "custom-mesh.conf", testPeer(t, mesh, 2).Config)
+}
+
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		form GenerationForm
+		want string
+	}{
+		{
+			name: "client parse",
+			form: GenerationForm{ClientTemplate: "[Interface]\nAddress = {{.Address"},
+			want: "failed to parse client template: template: client:2: unclosed action",
+		},
+		{
+			name: "server parse",
+			form: GenerationForm{ServerTemplate: "{{if .Address}}"},
+			want: "failed to parse server template: template: server:1: unexpected EOF",
+		},
+		{
+			name: "server peer parse",
+			form: GenerationForm{ServerPeerTemplate: "{{nope .Peer}}"},
+			want: `failed to parse serverPeer template: template: serverPeer:1: function "nope" not defined`,
+		},
+		{
+			name: "mesh parse",
+			form: GenerationForm{MeshTemplate: "{{end}}"},
+			want: "failed to parse mesh template: template: mesh:1: unexpected {{end}}",
+		},
+		{
+			name: "client execute",
+			form: GenerationForm{ClientTemplate: "Address = {{.Nope}}"},
+			want: "failed to render client template: template: client:1:12: executing \"client\" at <.Nope>: " +
+				"can't evaluate field Nope in type gen.ClientTemplateData",
+		},
+		{
+			name: "server execute",
+			form: GenerationForm{ServerTemplate: "{{join .Address \", \"}}"},
+			want: "failed to render server template: template: server:1:7: executing \"server\" at <.Address>: " +
+				"wrong type for value; expected []string; got string",
+		},
+	}
+
+	for _, tt := range tests {
+		conf := loadTestNetwork(t)
+		conf.GenerationParams.ClientTemplate = tt.form.ClientTemplate
+		conf.GenerationParams.ServerTemplate = tt.form.ServerTemplate
+		conf.GenerationParams.ServerPeerTemplate = tt.form.ServerPeerTemplate
+		conf.GenerationParams.MeshTemplate = tt.form.MeshTemplate
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err == nil {
+			t.Fatalf("%v: expected an error", tt.name)
+		}
+
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: expected the error to contain %q, got %q", tt.name, tt.want, err.Error())
+		}
+	}
+}
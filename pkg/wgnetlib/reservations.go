@@ -0,0 +1,118 @@
+package gen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reservation pins the peer with the given name to an address, such as a DNS
+// server that must always be reachable at the same address. If no peer has
+// the name, a new peer with that name is created at the address.
+type Reservation struct {
+	// Name is the name of the peer.
+	Name string `yaml:"name" json:"name" toml:"name"`
+	// IP is the reserved address within the CIDR.
+	IP string `yaml:"ip" json:"ip" toml:"ip"`
+}
+
+// parseReservations validates the reservations from the GenerationForm and
+// indexes them by ip address. Reserved addresses must be usable addresses
+// within the CIDR that aren't used by the server or a hub. parseHubs must be
+// called first.
+func (conf *Configuration) parseReservations() error {
+	conf.reservations = make(map[string]string, len(conf.GenerationParams.Reservations))
+	names := make(map[string]bool, len(conf.GenerationParams.Reservations))
+
+	for _, r := range conf.GenerationParams.Reservations {
+		name := strings.TrimSpace(r.Name)
+		if name == "" {
+			return fmt.Errorf("reservation for %v has no name", r.IP)
+		}
+
+		ip := net.ParseIP(strings.TrimSpace(r.IP))
+		if ip == nil {
+			return fmt.Errorf("reservation for %v is not an ip address: %v", name, r.IP)
+		}
+
+		if !conf.addresses.IsUsable(ip) {
+			return fmt.Errorf(
+				"reservation for %v must be a usable ip address within the range %v that isn't excluded: %v",
+				name,
+				conf.GenerationParams.CIDR,
+				r.IP,
+			)
+		}
+
+		if ip.Equal(conf.serverIP) {
+			return fmt.Errorf("reservation for %v must not be the same as the server %v", name, conf.GenerationParams.Server)
+		}
+
+		if conf.isHubIP(ip.String()) {
+			return fmt.Errorf("reservation for %v must not be the same as the hub %v", name, r.IP)
+		}
+
+		if other, ok := conf.reservations[ip.String()]; ok {
+			return fmt.Errorf("%v is reserved for both %v and %v", r.IP, other, name)
+		}
+
+		if names[name] {
+			return fmt.Errorf("%v has more than one reservation", name)
+		}
+
+		conf.reservations[ip.String()] = name
+		names[name] = true
+	}
+
+	return nil
+}
+
+// reservedPeers returns the index of the existing peer named by each of the
+// reservations, keyed by the reserved ip address, or -1 if no peer has the
+// name yet.
+func (conf *Configuration) reservedPeers(existing []WgConfig) (map[string]int, error) {
+	result := make(map[string]int, len(conf.reservations))
+	if len(conf.reservations) == 0 {
+		return result, nil
+	}
+
+	byName := make(map[string]string, len(conf.reservations))
+
+	for ip, name := range conf.reservations {
+		byName[name] = ip
+		result[ip] = -1
+	}
+
+	for l, w := range existing {
+		ip, ok := byName[w.Name]
+		if !ok {
+			continue
+		}
+
+		if result[ip] >= 0 {
+			return nil, fmt.Errorf(
+				"%v is reserved for %v, but both peer %v and peer %v are named %v",
+				ip,
+				w.Name,
+				existing[result[ip]].ID,
+				w.ID,
+				w.Name,
+			)
+		}
+
+		result[ip] = l
+	}
+
+	return result, nil
+}
+
+// reservedIP returns the address reserved for the name, if any.
+func (conf *Configuration) reservedIP(name string) (net.IP, bool) {
+	for ip, n := range conf.reservations {
+		if n == name {
+			return net.ParseIP(ip), true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,189 @@
+package gen
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// peerAt returns the peer with the given ip address.
+func peerAt(t *testing.T, conf *Configuration, ip string) WgConfig {
+	t.Helper()
+
+	for _, w := range conf.Peers {
+		if w.IP == ip {
+			return w
+		}
+	}
+
+	t.Fatalf("no peer found at %v", ip)
+
+	return WgConfig{}
+}
+
+func TestReservationNamedLikeServer(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		conf := loadTestNetwork(t)
+		conf.GenerationParams.Sparse = sparse
+		conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.4"}}
+
+		// leave room for the peer at the reserved address to be moved
+		conf.Peers = conf.Peers[:5]
+
+		server := testPeer(t, conf, 1)
+		server.Name = "dns"
+		publicKey := server.PublicKey
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err != nil {
+			t.Fatalf("sparse %v: failed to generate: %v", sparse, err)
+		}
+
+		got := peerAt(t, conf, "10.0.0.1")
+		if !got.IsServer || got.PublicKey != publicKey {
+			t.Errorf("sparse %v: expected the server to keep its address and keys", sparse)
+		}
+
+		reserved := peerAt(t, conf, "10.0.0.4")
+		if reserved.IsServer || reserved.Name != "dns" || reserved.PublicKey == publicKey {
+			t.Errorf("sparse %v: expected a new peer named dns at the reserved address", sparse)
+		}
+	}
+}
+
+func TestReservationDisplacesPeer(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		conf := loadTestNetwork(t)
+		conf.GenerationParams.Sparse = sparse
+
+		// leave room for the peer at the reserved address to be moved
+		conf.Peers = conf.Peers[:5]
+
+		old := testPeer(t, conf, 3)
+		old.Name = "dev3"
+		uid, privateKey := old.UID, old.PrivateKey
+
+		conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.3"}}
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err != nil {
+			t.Fatalf("sparse %v: failed to generate: %v", sparse, err)
+		}
+
+		moved := testPeer(t, conf, 3)
+		if moved.UID != uid || moved.PrivateKey != privateKey {
+			t.Fatalf("sparse %v: expected peer 3 to keep its uid and keys", sparse)
+		}
+
+		if moved.Name != "dev3" || moved.IP != "10.0.0.6" {
+			t.Errorf("sparse %v: expected dev3 to move to 10.0.0.6, got %v at %v", sparse, moved.Name, moved.IP)
+		}
+
+		reserved := peerAt(t, conf, "10.0.0.3")
+		if reserved.Name != "dns" || reserved.UID == uid || reserved.PrivateKey == privateKey {
+			t.Errorf("sparse %v: expected a new peer named dns at the reserved address", sparse)
+		}
+	}
+}
+
+func TestReservationNoFreeAddress(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		conf := loadTestNetwork(t)
+		conf.GenerationParams.Sparse = sparse
+		conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.3"}}
+
+		peers := slices.Clone(conf.Peers)
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err == nil {
+			t.Fatalf("sparse %v: expected an error, since every address is taken", sparse)
+		}
+
+		if !reflect.DeepEqual(conf.Peers, peers) {
+			t.Errorf("sparse %v: the peers were changed by a failed run", sparse)
+		}
+	}
+}
+
+// peerIdentity is what must stay the same for a peer across runs.
+type peerIdentity struct {
+	name       string
+	privateKey string
+	publicKey  string
+}
+
+func TestReservationsKeepPeerIdentity(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		conf := loadTestNetwork(t)
+		conf.GenerationParams.Sparse = sparse
+
+		// leave room for the peers at the reserved addresses to be moved
+		conf.Peers = conf.Peers[:4]
+
+		identities := map[string]peerIdentity{}
+
+		for i := range conf.Peers {
+			w := &conf.Peers[i]
+			w.Name = fmt.Sprintf("dev%v", w.ID)
+			identities[w.UID] = peerIdentity{w.Name, w.PrivateKey, w.PublicKey}
+		}
+
+		// the reservations are added, and then swapped
+		for _, reservations := range [][]Reservation{
+			{{Name: "dns", IP: "10.0.0.3"}, {Name: "ntp", IP: "10.0.0.4"}},
+			{{Name: "dns", IP: "10.0.0.4"}, {Name: "ntp", IP: "10.0.0.3"}},
+		} {
+			conf.GenerationParams.Reservations = reservations
+
+			plan, err := conf.Plan()
+			if err != nil {
+				t.Fatalf("sparse %v: failed to plan: %v", sparse, err)
+			}
+
+			for _, p := range plan.Changed {
+				if _, ok := identities[p.UID]; !ok {
+					continue
+				}
+
+				for _, f := range p.Fields {
+					switch f.Field {
+					case "name", "privateKey", "publicKey":
+						t.Errorf("sparse %v: plan changes the %v of peer %v", sparse, f.Field, p.ID)
+					}
+				}
+			}
+
+			err = conf.GenerateWithOptions(GenerateOptions{})
+			if err != nil {
+				t.Fatalf("sparse %v: failed to generate: %v", sparse, err)
+			}
+
+			found := 0
+
+			for _, w := range conf.Peers {
+				want, ok := identities[w.UID]
+				if !ok {
+					continue
+				}
+
+				found++
+
+				if got := (peerIdentity{w.Name, w.PrivateKey, w.PublicKey}); got != want {
+					t.Errorf("sparse %v: peer %v changed from %v to %v", sparse, w.UID, want.name, got.name)
+				}
+			}
+
+			if found != len(identities) {
+				t.Errorf("sparse %v: expected %v of the previous peers, got %v", sparse, len(identities), found)
+			}
+
+			for _, ip := range []string{"10.0.0.3", "10.0.0.4"} {
+				w := peerAt(t, conf, ip)
+				if _, ok := identities[w.UID]; ok {
+					t.Errorf("sparse %v: expected a reserved peer at %v, got %v", sparse, ip, w.Name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package gen
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// KeyRotation selects the peers whose keys are replaced by RotateKeys. Every
+// criterion that is set must match for a peer to be selected, and at least
+// one of IDs, NamePattern or OlderThan must be set. The server and hubs are
+// never rotated, since every other peer would need a new config at once; use
+// RegenerateKeys for those instead. External peers are never rotated either,
+// since they own their keys.
+type KeyRotation struct {
+	// IDs selects the peers with the given IDs.
+	IDs []uint
+	// NamePattern selects the peers whose name matches the pattern, using the
+	// syntax of path.Match, such as "laptop-*".
+	NamePattern string
+	// OlderThan selects the peers whose keys were created, as recorded in
+	// KeysCreatedAt, more than OlderThan ago. Peers without KeysCreatedAt
+	// are never selected by age.
+	OlderThan time.Duration
+	// Limit rotates at most this many of the selected peers, lowest ID first,
+	// so that large networks can be rotated in batches. If 0, every selected
+	// peer is rotated.
+	Limit uint
+}
+
+// validate ensures that the rotation selects peers in a meaningful way.
+func (r KeyRotation) validate() error {
+	if len(r.IDs) == 0 && r.NamePattern == "" && r.OlderThan <= 0 {
+		return fmt.Errorf("no peers selected for rotation, set the ids, name pattern or age")
+	}
+
+	if r.NamePattern != "" {
+		_, err := path.Match(r.NamePattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid name pattern %v: %w", r.NamePattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if w is selected by the rotation at the given time.
+func (r KeyRotation) matches(w WgConfig, now time.Time) bool {
+	if w.IsServer || w.IsHub || w.External {
+		return false
+	}
+
+	if len(r.IDs) > 0 && !slices.Contains(r.IDs, w.ID) {
+		return false
+	}
+
+	if r.NamePattern != "" {
+		ok, _ := path.Match(r.NamePattern, w.Name)
+		if !ok {
+			return false
+		}
+	}
+
+	if r.OlderThan > 0 && (w.KeysCreatedAt == nil || now.Sub(*w.KeysCreatedAt) <= r.OlderThan) {
+		return false
+	}
+
+	return true
+}
+
+// RotateKeys replaces the keypair and preshared keys of the peers selected by
+// rotation, and regenerates the configuration. Unlike RegenerateKeys, every
+// other peer keeps its keys, so only the rotated peers need new configs. Each
+// rotated peer's previous public & preshared keys are kept along with the
+// time of the rotation, so that TransitionalServerConfig can keep accepting
+// them while the new configs are rolled out.
+//
+// The IDs of the rotated peers are returned. If generating fails, the
+// configuration is left untouched.
+//
+// RotateKeys is equivalent to calling RotateKeysWithOptions with the zero
+// value of GenerateOptions.
+func (conf *Configuration) RotateKeys(rotation KeyRotation) ([]uint, error) {
+	return conf.RotateKeysWithOptions(rotation, GenerateOptions{})
+}
+
+// RotateKeysWithOptions behaves the same as RotateKeys, but regenerates the
+// configuration with opts, such as to report progress. Since the rotated keys
+// are kept in conf.Peers, opts can't have a Store or a Sink.
+func (conf *Configuration) RotateKeysWithOptions(rotation KeyRotation, opts GenerateOptions) ([]uint, error) {
+	if opts.Store != nil || opts.Sink != nil {
+		return nil, fmt.Errorf("key rotation cannot be combined with a store or a sink")
+	}
+
+	err := rotation.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range rotation.IDs {
+		i := slices.IndexFunc(conf.Peers, func(w WgConfig) bool {
+			return w.ID == id
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("no peer found with id %v", id)
+		}
+
+		if conf.Peers[i].IsServer || conf.Peers[i].IsHub {
+			return nil, fmt.Errorf("cannot rotate the keys of the server or hub peer %v, use regenerateKeys instead", id)
+		}
+
+		if conf.Peers[i].External {
+			return nil, fmt.Errorf("cannot rotate the keys of the external peer %v, which owns its keys", id)
+		}
+	}
+
+	now := time.Now().UTC()
+
+	peers := slices.Clone(conf.Peers)
+
+	// peers are rotated lowest ID first, regardless of their order
+	order := make([]int, len(peers))
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(peers[a].ID, peers[b].ID)
+	})
+
+	rotated := []uint{}
+	isRotated := make(map[uint]bool)
+
+	for _, i := range order {
+		if rotation.Limit > 0 && uint(len(rotated)) >= rotation.Limit {
+			break
+		}
+
+		if !rotation.matches(peers[i], now) {
+			continue
+		}
+
+		err = peers[i].replaceKeys(now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rotate keys of peer %v: %w", peers[i].ID, err)
+		}
+
+		rotated = append(rotated, peers[i].ID)
+		isRotated[peers[i].ID] = true
+	}
+
+	if len(rotated) == 0 {
+		return rotated, nil
+	}
+
+	// the rotated peers need new preshared keys with every other peer
+	presharedKeys := make([]PresharedKey, 0, len(conf.PresharedKeys))
+
+	for _, k := range conf.PresharedKeys {
+		if !isRotated[k.Peers[0]] && !isRotated[k.Peers[1]] {
+			presharedKeys = append(presharedKeys, k)
+		}
+	}
+
+	previousPeers, previousKeys := conf.Peers, conf.PresharedKeys
+	conf.Peers, conf.PresharedKeys = peers, presharedKeys
+
+	err = conf.GenerateWithOptions(opts)
+	if err != nil {
+		conf.Peers, conf.PresharedKeys = previousPeers, previousKeys
+
+		return nil, err
+	}
+
+	return rotated, nil
+}
+
+// inTransition returns true if w's keys were rotated within gracePeriod of
+// now, and it still has its previous keys.
+func (w *WgConfig) inTransition(now time.Time, gracePeriod time.Duration) bool {
+	return w.PreviousPublicKey != "" && w.RotatedAt != nil && now.Sub(*w.RotatedAt) < gracePeriod
+}
+
+// TransitionalServerConfig renders the server's config with every peer whose
+// keys were rotated within the last gracePeriod still using its previous
+// public & preshared keys. Deploying it instead of the server's regular config
+// keeps those peers connected until they receive their new configs, so that
+// keys can be rolled out in batches; once the grace period is over, each peer
+// is expected to be using its new keys. The configuration must have already
+// been generated.
+//
+// Only the server's config is covered. The rotated peers can't reach any hubs
+// until they receive their new configs.
+//
+// The configuration is left untouched, so any preshared keys that are missing
+// from it are generated for the render only.
+func (conf *Configuration) TransitionalServerConfig(gracePeriod time.Duration) (string, error) {
+	// rendering happens on a copy, the same as planning
+	rendered := *conf
+	rendered.Peers = slices.Clone(conf.Peers)
+	rendered.PresharedKeys = slices.Clone(conf.PresharedKeys)
+
+	return rendered.transitionalServerConfig(gracePeriod, time.Now().UTC())
+}
+
+// transitionalServerConfig implements TransitionalServerConfig, and modifies
+// conf while rendering.
+func (conf *Configuration) transitionalServerConfig(gracePeriod time.Duration, now time.Time) (string, error) {
+	if conf.isMesh() {
+		return "", fmt.Errorf("transitional server configs are not supported by the %v topology", TopologyMesh)
+	}
+
+	err := conf.parseNetwork()
+	if err != nil {
+		return "", err
+	}
+
+	err = conf.parseTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	err = conf.parseRoutedSubnets(conf.Peers)
+	if err != nil {
+		return "", err
+	}
+
+	serverIndex := conf.serverIndex()
+	if serverIndex < 0 {
+		return "", fmt.Errorf("no server found, generate the configuration first")
+	}
+
+	conf.loadPresharedKeys(conf.Peers, false)
+
+	server := conf.Peers[serverIndex]
+	nodes := []WgConfig{server}
+
+	for _, w := range conf.Peers {
+		if w.IsHub {
+			nodes = append(nodes, w)
+		}
+	}
+
+	iface, err := server.serverInterfaceConfig(conf, conf.network, nodes)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate server config: %w", err)
+	}
+
+	var config strings.Builder
+
+	config.WriteString(iface)
+
+	for _, w := range conf.Peers {
+		if w.IsServer || w.IsHub {
+			continue
+		}
+
+		var s string
+
+		if w.inTransition(now, gracePeriod) {
+			psk := w.PreviousPreSharedKey
+			w.PublicKey = w.PreviousPublicKey
+			s, err = conf.renderServerPeerWithKey(server, w, psk)
+		} else {
+			s, err = conf.renderServerPeer(server, w)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to render peer %v: %w", w.ID, err)
+		}
+
+		config.WriteString(s)
+	}
+
+	return config.String(), nil
+}
@@ -0,0 +1,178 @@
+package gen
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rotationNetwork returns the test network with named clients, whose keys
+// were created at different times.
+func rotationNetwork(t *testing.T) *Configuration {
+	t.Helper()
+
+	conf := loadTestNetwork(t)
+
+	now := time.Now().UTC()
+	old := now.Add(-100 * 24 * time.Hour)
+
+	names := map[uint]string{2: "laptop-a", 3: "phone", 4: "laptop-b", 5: "tablet", 6: "desktop"}
+
+	for i := range conf.Peers {
+		w := &conf.Peers[i]
+		w.Name = names[w.ID]
+		w.KeysCreatedAt = &now
+	}
+
+	// peer 5's keys are old, even though it was rotated recently, while
+	// peer 6's keys are new, even though it was last rotated long ago
+	testPeer(t, conf, 5).KeysCreatedAt = &old
+	testPeer(t, conf, 5).RotatedAt = &now
+	testPeer(t, conf, 6).RotatedAt = &old
+
+	// rotation doesn't depend on the order of the peers
+	slices.Reverse(conf.Peers)
+
+	return conf
+}
+
+func TestRotateKeysSelection(t *testing.T) {
+	tests := map[string]struct {
+		rotation KeyRotation
+		want     []uint
+	}{
+		"ids":             {rotation: KeyRotation{IDs: []uint{3, 6}}, want: []uint{3, 6}},
+		"name pattern":    {rotation: KeyRotation{NamePattern: "laptop-*"}, want: []uint{2, 4}},
+		"older than":      {rotation: KeyRotation{OlderThan: 90 * 24 * time.Hour}, want: []uint{5}},
+		"ids & name":      {rotation: KeyRotation{IDs: []uint{2, 3}, NamePattern: "laptop-*"}, want: []uint{2}},
+		"limit":           {rotation: KeyRotation{NamePattern: "*", Limit: 2}, want: []uint{2, 3}},
+		"server excluded": {rotation: KeyRotation{NamePattern: "*"}, want: []uint{2, 3, 4, 5, 6}},
+		"no match":        {rotation: KeyRotation{NamePattern: "router-*"}, want: []uint{}},
+	}
+
+	for name, tt := range tests {
+		conf := rotationNetwork(t)
+
+		got, err := conf.RotateKeys(tt.rotation)
+		if err != nil {
+			t.Fatalf("%v: failed to rotate: %v", name, err)
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%v: expected %v to be rotated, got %v", name, tt.want, got)
+		}
+	}
+}
+
+func TestRotateKeysInvalid(t *testing.T) {
+	tests := map[string]KeyRotation{
+		"nothing selected": {Limit: 1},
+		"server":           {IDs: []uint{1}},
+		"unknown id":       {IDs: []uint{99}},
+		"bad pattern":      {NamePattern: "["},
+	}
+
+	for name, rotation := range tests {
+		conf := rotationNetwork(t)
+		peers := slices.Clone(conf.Peers)
+
+		_, err := conf.RotateKeys(rotation)
+		if err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+
+		if !reflect.DeepEqual(conf.Peers, peers) {
+			t.Errorf("%v: peers were changed by a failed rotation", name)
+		}
+	}
+}
+
+func TestRotateKeysRecordsPreviousKeys(t *testing.T) {
+	conf := rotationNetwork(t)
+	before := *testPeer(t, conf, 3)
+	untouched := *testPeer(t, conf, 4)
+
+	start := time.Now().UTC()
+
+	_, err := conf.RotateKeys(KeyRotation{IDs: []uint{3}})
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+
+	after := testPeer(t, conf, 3)
+
+	if after.PublicKey == before.PublicKey || after.PrivateKey == before.PrivateKey {
+		t.Error("expected new keys for the rotated peer")
+	}
+
+	if after.PreviousPublicKey != before.PublicKey || after.PreviousPreSharedKey != before.PreSharedKey {
+		t.Error("expected the previous keys to be recorded")
+	}
+
+	if after.RotatedAt == nil || after.RotatedAt.Before(start) {
+		t.Errorf("expected rotatedAt to be recorded, got %v", after.RotatedAt)
+	}
+
+	if after.KeysCreatedAt == nil || !after.KeysCreatedAt.Equal(*after.RotatedAt) {
+		t.Errorf("expected keysCreatedAt to be the time of the rotation, got %v", after.KeysCreatedAt)
+	}
+
+	if !strings.Contains(after.Config, after.PrivateKey) {
+		t.Error("expected the rotated peer's config to use its new keys")
+	}
+
+	if got := *testPeer(t, conf, 4); got.PublicKey != untouched.PublicKey || got.PreviousPublicKey != "" {
+		t.Error("expected the other peers to keep their keys")
+	}
+}
+
+func TestTransitionalServerConfig(t *testing.T) {
+	conf := rotationNetwork(t)
+
+	_, err := conf.RotateKeys(KeyRotation{IDs: []uint{2, 3}})
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+
+	// peer 3 was rotated before the grace period
+	expired := time.Now().UTC().Add(-48 * time.Hour)
+	testPeer(t, conf, 3).RotatedAt = &expired
+
+	// a missing pair key must not be added to the configuration
+	conf.PresharedKeys = slices.DeleteFunc(conf.PresharedKeys, func(k PresharedKey) bool {
+		return k.Peers == [2]uint{1, 4}
+	})
+
+	peers := slices.Clone(conf.Peers)
+	keys := slices.Clone(conf.PresharedKeys)
+	psks := conf.psks
+
+	got, err := conf.TransitionalServerConfig(24 * time.Hour)
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+
+	inTransition := testPeer(t, conf, 2)
+	if !strings.Contains(got, inTransition.PreviousPublicKey) || strings.Contains(got, inTransition.PublicKey) {
+		t.Error("expected the peer within the grace period to use its previous key")
+	}
+
+	if !strings.Contains(got, inTransition.PreviousPreSharedKey) {
+		t.Error("expected the peer within the grace period to use its previous preshared key")
+	}
+
+	rotated := testPeer(t, conf, 3)
+	if strings.Contains(got, rotated.PreviousPublicKey) || !strings.Contains(got, rotated.PublicKey) {
+		t.Error("expected the peer outside of the grace period to use its new key")
+	}
+
+	if !reflect.DeepEqual(conf.Peers, peers) {
+		t.Error("peers were changed by rendering a transitional server config")
+	}
+
+	if !reflect.DeepEqual(conf.PresharedKeys, keys) || conf.psks != psks {
+		t.Error("preshared keys were changed by rendering a transitional server config")
+	}
+}
@@ -0,0 +1,153 @@
+package gen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// routedSubnet is a subnet behind a peer, such as the LAN of a router, that is
+// routed through the tunnel to that peer.
+type routedSubnet struct {
+	// id is the ID of the peer that the subnet is routed through.
+	id      uint
+	isHub   bool
+	network *net.IPNet
+}
+
+// overlaps returns true if either of the networks contains the other.
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// parseRoutedSubnets validates the RoutedSubnets of each of the peers, and
+// keeps track of them so that they can be added to the AllowedIPs of the
+// other peers. Routed subnets must be network addresses, and must not overlap
+// each other or the tunnel's CIDRs. parseNetwork must be called first.
+func (conf *Configuration) parseRoutedSubnets(peers []WgConfig) error {
+	conf.routes = nil
+
+	for _, w := range peers {
+		for _, s := range w.RoutedSubnets {
+			ip, network, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid routed subnet %v of peer %v: %w", s, w.ID, err)
+			}
+
+			if !ip.Equal(network.IP) {
+				return fmt.Errorf("routed subnet %v of peer %v is not a network address, did you mean %v?", s, w.ID, network)
+			}
+
+			if overlaps(network, conf.network) {
+				return fmt.Errorf("routed subnet %v of peer %v overlaps with cidr %v", s, w.ID, conf.GenerationParams.CIDR)
+			}
+
+			if conf.secondaryNetwork != nil && overlaps(network, conf.secondaryNetwork) {
+				return fmt.Errorf(
+					"routed subnet %v of peer %v overlaps with secondary cidr %v",
+					s,
+					w.ID,
+					conf.GenerationParams.SecondaryCIDR,
+				)
+			}
+
+			for _, r := range conf.routes {
+				if overlaps(network, r.network) {
+					return fmt.Errorf("routed subnet %v of peer %v overlaps with %v of peer %v", s, w.ID, r.network, r.id)
+				}
+			}
+
+			conf.routes = append(conf.routes, routedSubnet{id: w.ID, isHub: w.IsHub, network: network})
+		}
+	}
+
+	return nil
+}
+
+// appendAllowedIPs appends each of the subnets to the comma-separated
+// allowedIPs, except for those already covered by one of its entries.
+func appendAllowedIPs(allowedIPs string, subnets []*net.IPNet) string {
+	if len(subnets) == 0 {
+		return allowedIPs
+	}
+
+	result := []string{}
+	existing := []*net.IPNet{}
+
+	for _, s := range strings.Split(allowedIPs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		result = append(result, s)
+
+		_, network, err := net.ParseCIDR(s)
+		if err == nil {
+			existing = append(existing, network)
+		}
+	}
+
+	for _, subnet := range subnets {
+		covered := false
+
+		for _, e := range existing {
+			ones, _ := e.Mask.Size()
+			subnetOnes, _ := subnet.Mask.Size()
+
+			if e.Contains(subnet.IP) && ones <= subnetOnes {
+				covered = true
+
+				break
+			}
+		}
+
+		if !covered {
+			result = append(result, subnet.String())
+		}
+	}
+
+	return strings.Join(result, ", ")
+}
+
+// routedAddresses returns the peer's own address(es) followed by its routed
+// subnets, which is what other peers route through a direct connection to it.
+func (w *WgConfig) routedAddresses() string {
+	addresses := w.hostAddresses()
+
+	for _, s := range w.RoutedSubnets {
+		addresses = fmt.Sprintf("%v, %v", addresses, strings.TrimSpace(s))
+	}
+
+	return addresses
+}
+
+// clientAllowedIPs returns the AllowedIPs of the client w's [Peer] section for
+// the server, which includes the subnets routed through the server and through
+// every other client. Subnets routed through hubs are reached through the hubs
+// instead.
+func (conf *Configuration) clientAllowedIPs(w WgConfig) string {
+	subnets := []*net.IPNet{}
+
+	for _, r := range conf.routes {
+		if r.id != w.ID && !r.isHub {
+			subnets = append(subnets, r.network)
+		}
+	}
+
+	return appendAllowedIPs(w.AllowedIPs, subnets)
+}
+
+// hubAllowedIPs returns the AllowedIPs of a client's [Peer] section for the
+// hub, which includes the subnets routed through the hub.
+func (conf *Configuration) hubAllowedIPs(hub WgConfig) string {
+	subnets := []*net.IPNet{}
+
+	for _, r := range conf.routes {
+		if r.id == hub.ID {
+			subnets = append(subnets, r.network)
+		}
+	}
+
+	return appendAllowedIPs(hub.AllowedIPs, subnets)
+}
@@ -0,0 +1,74 @@
+package gen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutedSubnetOverlaps(t *testing.T) {
+	tests := []struct {
+		name string
+		// subnets are the routed subnets of each peer, by ID
+		subnets map[uint][]string
+		// err is a substring of the expected error, or "" if the subnets are
+		// valid
+		err string
+	}{
+		{
+			name:    "overlaps cidr",
+			subnets: map[uint][]string{3: {"10.0.0.0/24"}},
+			err:     "routed subnet 10.0.0.0/24 of peer 3 overlaps with cidr 10.0.0.0/29",
+		},
+		{
+			name:    "inside cidr",
+			subnets: map[uint][]string{3: {"10.0.0.4/30"}},
+			err:     "routed subnet 10.0.0.4/30 of peer 3 overlaps with cidr 10.0.0.0/29",
+		},
+		{
+			name:    "overlaps other peer",
+			subnets: map[uint][]string{3: {"192.168.0.0/16"}, 4: {"192.168.1.0/24"}},
+			err:     "routed subnet 192.168.1.0/24 of peer 4 overlaps with 192.168.0.0/16 of peer 3",
+		},
+		{
+			name:    "overlaps same peer",
+			subnets: map[uint][]string{3: {"192.168.1.0/24", "192.168.1.128/25"}},
+			err:     "routed subnet 192.168.1.128/25 of peer 3 overlaps with 192.168.1.0/24 of peer 3",
+		},
+		{
+			name:    "disjoint",
+			subnets: map[uint][]string{3: {"192.168.1.0/24"}, 4: {"192.168.2.0/24", "172.16.0.0/12"}},
+		},
+	}
+
+	for _, test := range tests {
+		conf := loadTestNetwork(t)
+
+		for id, subnets := range test.subnets {
+			testPeer(t, conf, id).RoutedSubnets = subnets
+		}
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: failed to generate: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%v: expected an error", test.name)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%v: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+
+		if err != nil || test.err != "" {
+			continue
+		}
+
+		want := 0
+		for _, subnets := range test.subnets {
+			want += len(subnets)
+		}
+
+		if len(conf.routes) != want {
+			t.Errorf("%v: expected %v routed subnets, got %v", test.name, want, len(conf.routes))
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package gen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseSecondaryNetwork validates the optional secondary CIDR and server
+// address from the GenerationForm, and excludes the exclusions that are within
+// the secondary CIDR. The remaining exclusions are returned. If no secondary
+// CIDR is configured, the secondary network is cleared.
+func (conf *Configuration) parseSecondaryNetwork(exclusions []addressSpan) ([]addressSpan, error) {
+	conf.secondaryNetwork = nil
+	conf.secondaryAddresses = nil
+	conf.secondaryServerIP = nil
+
+	if conf.GenerationParams.SecondaryCIDR == "" {
+		return exclusions, nil
+	}
+
+	_, secondaryNet, err := ParseAlignedCIDR(conf.GenerationParams.SecondaryCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secondary cidr: %w", err)
+	}
+
+	if secondaryNet.Contains(conf.network.IP) || conf.network.Contains(secondaryNet.IP) {
+		return nil, fmt.Errorf(
+			"secondary cidr %v must not overlap with cidr %v",
+			conf.GenerationParams.SecondaryCIDR,
+			conf.GenerationParams.CIDR,
+		)
+	}
+
+	addresses := NewAddressRange(secondaryNet)
+	exclusions = addresses.excludeSpans(exclusions)
+
+	var secondaryServer net.IP
+
+	if conf.GenerationParams.SecondaryServer == "" {
+		secondaryServer = addresses.First()
+		if secondaryServer == nil {
+			return nil, fmt.Errorf("secondary cidr has no usable addresses: %v", conf.GenerationParams.SecondaryCIDR)
+		}
+	} else {
+		secondaryServer = net.ParseIP(conf.GenerationParams.SecondaryServer)
+		if secondaryServer == nil {
+			return nil, fmt.Errorf("secondary server is not an ip address: %v", conf.GenerationParams.SecondaryServer)
+		}
+
+		if !addresses.IsUsable(secondaryServer) {
+			return nil, fmt.Errorf(
+				"secondary server must be a usable ip address within the range %v that isn't excluded: %v",
+				conf.GenerationParams.SecondaryCIDR,
+				conf.GenerationParams.SecondaryServer,
+			)
+		}
+	}
+
+	conf.secondaryNetwork = secondaryNet
+	conf.secondaryAddresses = addresses
+	conf.secondaryServerIP = secondaryServer
+
+	return exclusions, nil
+}
+
+// allocateSecondaryIPs determines the secondary address of every peer that
+// will be generated, keyed by peer ID. Secondary addresses of existing peers
+// are kept whenever they are still valid, and every other peer receives the
+// next free address in the secondary network. Returns nil if no secondary
+// network is configured.
+func (conf *Configuration) allocateSecondaryIPs(existing []WgConfig, slots []peerSlot) (map[uint]string, error) {
+	if conf.secondaryNetwork == nil {
+		return nil, nil
+	}
+
+	result := make(map[uint]string, len(slots))
+	used := make(map[string]bool, len(slots))
+
+	// the server's secondary address is always determined by the form
+	for _, slot := range slots {
+		if slot.ip.IsServerIP {
+			s := conf.secondaryServerIP.String()
+			result[slot.id] = s
+			used[s] = true
+
+			break
+		}
+	}
+
+	// keep whatever existing peers already had, as long as it's still valid
+	for _, slot := range slots {
+		if slot.ip.IsServerIP || slot.existing < 0 {
+			continue
+		}
+
+		prev := net.ParseIP(existing[slot.existing].SecondaryIP)
+		if prev == nil || !conf.secondaryAddresses.IsUsable(prev) || used[prev.String()] {
+			continue
+		}
+
+		result[slot.id] = prev.String()
+		used[prev.String()] = true
+	}
+
+	// hand out the remaining free addresses in order
+	ip := conf.secondaryNetwork.IP
+
+	for _, slot := range slots {
+		if _, ok := result[slot.id]; ok {
+			continue
+		}
+
+		ip = conf.secondaryAddresses.Next(ip, used)
+		if ip == nil {
+			return nil, fmt.Errorf(
+				"secondary cidr %v is too small to hold %v peers",
+				conf.GenerationParams.SecondaryCIDR,
+				len(slots),
+			)
+		}
+
+		result[slot.id] = ip.String()
+		used[ip.String()] = true
+	}
+
+	return result, nil
+}
+
+// defaultAllowedIPs returns the AllowedIPs that route all traffic for every
+// address family in use by the network.
+func (conf *Configuration) defaultAllowedIPs() string {
+	allowedIPs := []string{}
+
+	for _, n := range []*net.IPNet{conf.network, conf.secondaryNetwork} {
+		if n == nil {
+			continue
+		}
+
+		defaultRoute := DefaultAllowedIPs
+		if IsIPv6(n.IP) {
+			defaultRoute = DefaultAllowedIPsIPv6
+		}
+
+		if len(allowedIPs) == 0 || allowedIPs[0] != defaultRoute {
+			allowedIPs = append(allowedIPs, defaultRoute)
+		}
+	}
+
+	if len(allowedIPs) == 0 {
+		return DefaultAllowedIPs
+	}
+
+	return strings.Join(allowedIPs, ", ")
+}
+
+// hostAddresses returns the peer's primary address, and secondary address if
+// it has one, as single-host CIDRs suitable for Address and AllowedIPs lines.
+func (w *WgConfig) hostAddresses() string {
+	addresses := fmt.Sprintf("%v/%v", w.IP, HostPrefixLen(net.ParseIP(w.IP)))
+
+	if w.SecondaryIP != "" {
+		addresses = fmt.Sprintf("%v, %v/%v", addresses, w.SecondaryIP, HostPrefixLen(net.ParseIP(w.SecondaryIP)))
+	}
+
+	return addresses
+}
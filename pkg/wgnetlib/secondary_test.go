@@ -0,0 +1,67 @@
+package gen
+
+import (
+	"slices"
+	"testing"
+)
+
+// secondaryIPs returns each peer's secondary address, keyed by id.
+func secondaryIPs(conf *Configuration) map[uint]string {
+	result := make(map[uint]string, len(conf.Peers))
+
+	for _, w := range conf.Peers {
+		result[w.ID] = w.SecondaryIP
+	}
+
+	return result
+}
+
+func TestSecondaryIPsKept(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		conf := loadTestNetwork(t)
+		conf.GenerationParams.Sparse = sparse
+		conf.GenerationParams.SecondaryCIDR = "fd00::/120"
+
+		err := conf.GenerateWithOptions(GenerateOptions{})
+		if err != nil {
+			t.Fatalf("sparse %v: failed to generate: %v", sparse, err)
+		}
+
+		// an address that wouldn't be allocated in order, as if it was set by
+		// hand
+		testPeer(t, conf, 3).SecondaryIP = "fd00::10"
+
+		want := secondaryIPs(conf)
+
+		conf = regenerate(t, conf)
+
+		got := secondaryIPs(conf)
+		for id, ip := range want {
+			if got[id] != ip {
+				t.Errorf("sparse %v: expected peer %v to keep %v, got %v", sparse, id, ip, got[id])
+			}
+		}
+
+		// deleting a peer doesn't affect the others
+		conf.Peers = slices.DeleteFunc(conf.Peers, func(w WgConfig) bool { return w.ID == 2 })
+
+		conf = regenerate(t, conf)
+
+		got = secondaryIPs(conf)
+		for id, ip := range want {
+			if id != 2 && got[id] != ip {
+				t.Errorf("sparse %v: expected peer %v to keep %v after deleting peer 2, got %v", sparse, id, ip, got[id])
+			}
+		}
+
+		seen := map[string]bool{}
+
+		for id, ip := range got {
+			if ip == "" || seen[ip] {
+				t.Errorf("sparse %v: peer %v has a missing or duplicate secondary address %v", sparse, id, ip)
+			}
+
+			seen[ip] = true
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package gen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a file format that a Configuration can be serialized to.
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+	FormatTOML Format = "toml"
+)
+
+// CurrentSchemaVersion is the schema version of configurations saved by this
+// version of the library. It must be incremented, and a migration added to
+// migrations, whenever a change is made to the Configuration struct that
+// requires older configurations to be converted.
+const CurrentSchemaVersion = 3
+
+// migrations upgrades a configuration from the schema version used as the key
+// to the next schema version.
+var migrations = map[int]func(conf *Configuration) error{
+	// version 0 configurations were saved before the schema was versioned,
+	// and are otherwise identical to version 1
+	0: func(conf *Configuration) error { return nil },
+	// version 2 identifies peers by their UID, which older peers don't have
+	1: func(conf *Configuration) error {
+		for i := range conf.Peers {
+			if conf.Peers[i].UID == "" {
+				conf.Peers[i].UID = GenerateUID()
+			}
+		}
+
+		return nil
+	},
+	// version 3 tracks when each peer's keys were created. Keys that were
+	// rotated are as old as their rotation, and since the age of any other
+	// keys is unknown, they're considered created when migrated, so that
+	// KeyRotation.OlderThan doesn't select them right away
+	2: func(conf *Configuration) error {
+		now := time.Now().UTC()
+
+		for i := range conf.Peers {
+			w := &conf.Peers[i]
+			if w.KeysCreatedAt != nil || w.External || w.PublicKey == "" {
+				continue
+			}
+
+			createdAt := now
+			if w.RotatedAt != nil {
+				createdAt = *w.RotatedAt
+			}
+
+			w.KeysCreatedAt = &createdAt
+		}
+
+		return nil
+	},
+}
+
+// FormatFromPath determines the Format to use for path based on its
+// extension.
+func FormatFromPath(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	case ".toml":
+		return FormatTOML, nil
+	default:
+		return "", fmt.Errorf("unable to determine format of %v, expected a .yml, .yaml, .json or .toml extension", path)
+	}
+}
+
+// Marshal serializes the configuration using the given format. The schema
+// version is set to CurrentSchemaVersion before serializing.
+func (conf *Configuration) Marshal(format Format) ([]byte, error) {
+	return conf.MarshalWithOptions(format, EncryptionOptions{})
+}
+
+// MarshalWithOptions behaves the same as Marshal, but encrypts the secret
+// fields if a passphrase or key file is set in opts. The configuration itself
+// is left untouched.
+func (conf *Configuration) MarshalWithOptions(format Format, opts EncryptionOptions) ([]byte, error) {
+	// a shallow copy is enough, since only top-level fields are changed
+	c := *conf
+	conf = &c
+	conf.Version = CurrentSchemaVersion
+	conf.Encryption = nil
+
+	if opts.enabled() {
+		enc, err := conf.encrypted(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		conf = enc
+	}
+
+	switch format {
+	case FormatYAML:
+		b, err := yaml.Marshal(conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal yaml: %w", err)
+		}
+
+		return b, nil
+	case FormatJSON:
+		b, err := json.MarshalIndent(conf, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal json: %w", err)
+		}
+
+		return append(b, '\n'), nil
+	case FormatTOML:
+		var buf bytes.Buffer
+
+		err := toml.NewEncoder(&buf).Encode(conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal toml: %w", err)
+		}
+
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %v", format)
+	}
+}
+
+// Unmarshal deserializes b into the configuration using the given format, and
+// then migrates it to CurrentSchemaVersion. Fields that are not present in b
+// are left untouched, so defaults can be set on the configuration beforehand.
+// If the configuration is encrypted, the returned error wraps ErrEncrypted.
+func (conf *Configuration) Unmarshal(b []byte, format Format) error {
+	return conf.UnmarshalWithOptions(b, format, EncryptionOptions{})
+}
+
+// UnmarshalWithOptions behaves the same as Unmarshal, but decrypts the secret
+// fields of an encrypted configuration using the passphrase or key file in
+// opts.
+func (conf *Configuration) UnmarshalWithOptions(b []byte, format Format, opts EncryptionOptions) error {
+	// a missing version means the configuration predates schema versioning
+	conf.Version = 0
+	conf.Encryption = nil
+
+	var err error
+
+	switch format {
+	case FormatYAML:
+		err = yaml.Unmarshal(b, conf)
+	case FormatJSON:
+		err = json.Unmarshal(b, conf)
+	case FormatTOML:
+		_, err = toml.Decode(string(b), conf)
+	default:
+		return fmt.Errorf("unsupported format: %v", format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal %v: %w", format, err)
+	}
+
+	err = conf.decrypt(opts)
+	if err != nil {
+		return err
+	}
+
+	return conf.migrate()
+}
+
+// migrate upgrades the configuration to CurrentSchemaVersion.
+func (conf *Configuration) migrate() error {
+	if conf.Version > CurrentSchemaVersion {
+		return fmt.Errorf(
+			"configuration has schema version %v, which is newer than the supported version %v",
+			conf.Version,
+			CurrentSchemaVersion,
+		)
+	}
+
+	for conf.Version < CurrentSchemaVersion {
+		migrate, ok := migrations[conf.Version]
+		if !ok {
+			return fmt.Errorf("no migration exists for schema version %v", conf.Version)
+		}
+
+		err := migrate(conf)
+		if err != nil {
+			return fmt.Errorf("failed to migrate from schema version %v: %w", conf.Version, err)
+		}
+
+		conf.Version++
+	}
+
+	return nil
+}
+
+// Load reads the configuration from path, using the format determined by its
+// extension. See Unmarshal for details. If the file doesn't exist, the
+// returned error wraps fs.ErrNotExist.
+func (conf *Configuration) Load(path string) error {
+	return conf.LoadWithOptions(path, EncryptionOptions{})
+}
+
+// LoadWithOptions behaves the same as Load, but decrypts an encrypted
+// configuration using the passphrase or key file in opts.
+func (conf *Configuration) LoadWithOptions(path string, opts EncryptionOptions) error {
+	format, err := FormatFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %w", path, err)
+	}
+
+	err = conf.UnmarshalWithOptions(b, format, opts)
+	if err != nil {
+		return fmt.Errorf("failed to load %v: %w", path, err)
+	}
+
+	return nil
+}
+
+// Save writes the configuration to path, using the format determined by its
+// extension. Since the configuration contains private keys, the file is only
+// readable by its owner.
+func (conf *Configuration) Save(path string) error {
+	return conf.SaveWithOptions(path, EncryptionOptions{})
+}
+
+// SaveWithOptions behaves the same as Save, but encrypts the secret fields if
+// a passphrase or key file is set in opts.
+func (conf *Configuration) SaveWithOptions(path string, opts EncryptionOptions) error {
+	format, err := FormatFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	b, err := conf.MarshalWithOptions(format, opts)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path, b, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %v: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package gen
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripNetwork returns the test network with a mix of set and unset
+// optional fields.
+func roundTripNetwork(t *testing.T) *Configuration {
+	t.Helper()
+
+	conf := loadTestNetwork(t)
+
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rotatedAt := time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	for i := range conf.Peers {
+		conf.Peers[i].KeysCreatedAt = &createdAt
+	}
+
+	client := testPeer(t, conf, 2)
+	client.RoutedSubnets = []string{"192.168.1.0/24"}
+	client.PreviousPublicKey = "previous-public-key"
+	client.PreviousPreSharedKey = "previous-psk"
+	client.RotatedAt = &rotatedAt
+
+	external := testPeer(t, conf, 3)
+	external.External = true
+	external.PrivateKey = ""
+
+	conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.4"}}
+
+	return conf
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	formats := []Format{FormatYAML, FormatJSON, FormatTOML}
+
+	for _, format := range formats {
+		conf := roundTripNetwork(t)
+
+		want, err := conf.Marshal(format)
+		if err != nil {
+			t.Fatalf("%v: failed to marshal: %v", format, err)
+		}
+
+		decoded := &Configuration{}
+
+		err = decoded.Unmarshal(want, format)
+		if err != nil {
+			t.Fatalf("%v: failed to unmarshal: %v", format, err)
+		}
+
+		got, err := decoded.Marshal(format)
+		if err != nil {
+			t.Fatalf("%v: failed to marshal decoded configuration: %v", format, err)
+		}
+
+		if string(got) != string(want) {
+			t.Errorf("%v: round trip differs, got:\n%s\nwant:\n%s", format, got, want)
+		}
+	}
+}
+
+func TestSerializeConversions(t *testing.T) {
+	want, err := roundTripNetwork(t).Marshal(FormatYAML)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	// yaml -> json -> toml -> yaml, and yaml -> toml -> json -> yaml
+	paths := [][]Format{
+		{FormatYAML, FormatJSON, FormatTOML, FormatYAML},
+		{FormatYAML, FormatTOML, FormatJSON, FormatYAML},
+	}
+
+	for _, path := range paths {
+		b := want
+
+		for i := 1; i < len(path); i++ {
+			conf := &Configuration{}
+
+			err = conf.Unmarshal(b, path[i-1])
+			if err != nil {
+				t.Fatalf("%v: failed to unmarshal %v: %v", path, path[i-1], err)
+			}
+
+			b, err = conf.Marshal(path[i])
+			if err != nil {
+				t.Fatalf("%v: failed to marshal %v: %v", path, path[i], err)
+			}
+		}
+
+		if string(b) != string(want) {
+			t.Errorf("%v: conversion differs, got:\n%s\nwant:\n%s", path, b, want)
+		}
+	}
+}
+
+func TestSerializeOmitsEmptyOptionalFields(t *testing.T) {
+	optional := []string{
+		"routedSubnets",
+		"external",
+		"previousPublicKey",
+		"previousPreSharedKey",
+		"rotatedAt",
+		"excludedAddresses",
+		"hubs",
+		"reservations",
+		"null",
+	}
+
+	for _, format := range []Format{FormatYAML, FormatJSON, FormatTOML} {
+		b, err := loadTestNetwork(t).Marshal(format)
+		if err != nil {
+			t.Fatalf("%v: failed to marshal: %v", format, err)
+		}
+
+		for _, field := range optional {
+			if strings.Contains(string(b), field) {
+				t.Errorf("%v: expected %v to be omitted", format, field)
+			}
+		}
+	}
+}
+
+func TestMarshalLeavesConfigurationUnchanged(t *testing.T) {
+	options := map[string]EncryptionOptions{
+		"plain":     {},
+		"encrypted": {Passphrase: "correct horse battery staple"},
+	}
+
+	for name, opts := range options {
+		conf := roundTripNetwork(t)
+		header := &Encryption{KDF: KDFScrypt}
+		conf.Version = 1
+		conf.Encryption = header
+		privateKey := testPeer(t, conf, 1).PrivateKey
+
+		_, err := conf.MarshalWithOptions(FormatYAML, opts)
+		if err != nil {
+			t.Fatalf("%v: failed to marshal: %v", name, err)
+		}
+
+		if conf.Version != 1 {
+			t.Errorf("%v: expected version 1 to be kept, got %v", name, conf.Version)
+		}
+
+		if conf.Encryption != header {
+			t.Errorf("%v: expected the encryption header to be kept, got %v", name, conf.Encryption)
+		}
+
+		if testPeer(t, conf, 1).PrivateKey != privateKey {
+			t.Errorf("%v: private key of peer 1 was changed", name)
+		}
+	}
+}
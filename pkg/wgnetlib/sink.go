@@ -0,0 +1,14 @@
+package gen
+
+// PeerSink receives generated peers one at a time, allowing them to be
+// written somewhere (such as to disk) without holding every peer in memory.
+type PeerSink interface {
+	Write(w WgConfig) error
+}
+
+// PeerSinkFunc adapts an ordinary function into a PeerSink.
+type PeerSinkFunc func(w WgConfig) error
+
+func (f PeerSinkFunc) Write(w WgConfig) error {
+	return f(w)
+}
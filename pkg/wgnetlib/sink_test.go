@@ -0,0 +1,83 @@
+package gen
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenerateSink(t *testing.T) {
+	hubs := []Hub{{IP: "10.0.0.3", Endpoint: "6.6.6.6"}}
+
+	// the same network is generated without streaming to compare against
+	want := loadTestNetwork(t)
+	want.GenerationParams.Hubs = hubs
+
+	err := want.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	// the keys of the hub's pairs are new, so they're carried over
+	conf := loadTestNetwork(t)
+	conf.GenerationParams.Hubs = hubs
+	conf.Peers = slices.Clone(want.Peers)
+	conf.PresharedKeys = slices.Clone(want.PresharedKeys)
+	peers := conf.Peers
+
+	var got []WgConfig
+
+	var server strings.Builder
+
+	err = conf.GenerateWithOptions(GenerateOptions{
+		Sink: PeerSinkFunc(func(w WgConfig) error {
+			got = append(got, w)
+
+			return nil
+		}),
+		ServerWriter: &server,
+	})
+	if err != nil {
+		t.Fatalf("failed to generate with a sink: %v", err)
+	}
+
+	// the clients in id order, followed by the hub & the server
+	ids := []uint{}
+	for _, w := range got {
+		ids = append(ids, w.ID)
+	}
+
+	if wantIDs := []uint{2, 4, 5, 6, 3, 1}; !slices.Equal(ids, wantIDs) {
+		t.Errorf("expected the peers in the order %v, got %v", wantIDs, ids)
+	}
+
+	if &conf.Peers[0] != &peers[0] || len(conf.Peers) != len(peers) {
+		t.Error("conf.Peers was replaced while streaming to a sink")
+	}
+
+	if server.String() != testPeer(t, want, 1).Config {
+		t.Errorf("the streamed server config doesn't match, got:\n%v\nwant:\n%v", server.String(), testPeer(t, want, 1).Config)
+	}
+
+	for _, w := range got {
+		expected := *testPeer(t, want, w.ID)
+
+		// the server's config is only written to the ServerWriter
+		if w.IsServer {
+			if w.Config != "" {
+				t.Error("expected the server's config to be left empty")
+			}
+
+			expected.Config = ""
+		}
+
+		if !reflect.DeepEqual(w, expected) {
+			t.Errorf("peer %v differs from the peer generated without a sink", w.ID)
+		}
+	}
+
+	if !reflect.DeepEqual(conf.PresharedKeys, want.PresharedKeys) {
+		t.Error("the preshared keys differ from the ones generated without a sink")
+	}
+}
@@ -0,0 +1,424 @@
+package gen
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// sparseSlots returns a slot for every existing peer, plus the server if it
+// doesn't exist yet. Like denseSlots, peers keep their IDs and IP addresses;
+// only peers whose address is no longer usable (for example, because the CIDR
+// changed) are moved to the next free address.
+func (conf *Configuration) sparseSlots(ctx context.Context, progress ProgressReporter, existing []WgConfig) ([]peerSlot, error) {
+	slots := make([]peerSlot, 0, len(existing)+1)
+	used := make(map[string]bool, len(existing)+1)
+	usedIDs := make(map[uint]bool, len(existing)+1)
+
+	var maxID uint
+
+	for _, w := range existing {
+		maxID = max(maxID, w.ID)
+	}
+
+	nextID := func() uint {
+		maxID++
+
+		return maxID
+	}
+
+	// the server always receives the address from the form. Prefer whichever
+	// peer already has that address, otherwise keep the previous server (for
+	// example, if the server address was moved to a new CIDR).
+	used[conf.serverIP.String()] = true
+	serverExisting := slices.IndexFunc(existing, func(w WgConfig) bool {
+		ip := net.ParseIP(w.IP)
+
+		return ip != nil && ip.Equal(conf.serverIP)
+	})
+
+	if serverExisting < 0 {
+		serverExisting = slices.IndexFunc(existing, func(w WgConfig) bool {
+			return w.IsServer
+		})
+	}
+
+	// hubs keep their addresses from the form too, so no other peer may use
+	// them. Whichever peer already has a hub's address becomes that hub.
+	hubClaimed := make(map[string]bool, len(conf.hubs))
+	for ip := range conf.hubs {
+		used[ip] = true
+	}
+
+	// reserved addresses can only be used by the peers they're reserved for
+	reserved, err := conf.reservedPeers(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	reservedIPs := make(map[int]string, len(reserved))
+
+	for ip, l := range reserved {
+		used[ip] = true
+
+		if l >= 0 && l != serverExisting {
+			reservedIPs[l] = ip
+		}
+	}
+
+	// peers that need to be moved to a new address, as indexes into slots
+	pending := []int{}
+
+	for l, w := range existing {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		progress.Increment(PhasePreProcessing)
+
+		slot := peerSlot{id: w.ID, existing: l}
+		if slot.id == 0 || usedIDs[slot.id] {
+			slot.id = nextID()
+		}
+
+		usedIDs[slot.id] = true
+
+		ip := net.ParseIP(w.IP)
+
+		switch {
+		case l == serverExisting:
+			slot.ip = IPAddress{S: conf.serverIP.String(), IP: conf.serverIP, IsServerIP: true}
+		case reservedIPs[l] != "":
+			slot.ip = IPAddress{S: reservedIPs[l], IP: net.ParseIP(reservedIPs[l])}
+			slot.name = conf.reservations[reservedIPs[l]]
+		case ip != nil && conf.isHubIP(ip.String()) && !hubClaimed[ip.String()]:
+			hubClaimed[ip.String()] = true
+			slot.ip = IPAddress{S: ip.String(), IP: ip}
+		case ip == nil || !conf.addresses.IsUsable(ip) || used[ip.String()]:
+			pending = append(pending, len(slots))
+		default:
+			used[ip.String()] = true
+			slot.ip = IPAddress{S: ip.String(), IP: ip}
+		}
+
+		slots = append(slots, slot)
+	}
+
+	if serverExisting < 0 {
+		progress.Increment(PhasePreProcessing)
+
+		slots = append(slots, peerSlot{
+			id:       nextID(),
+			ip:       IPAddress{S: conf.serverIP.String(), IP: conf.serverIP, IsServerIP: true},
+			existing: -1,
+		})
+	}
+
+	for _, hub := range conf.GenerationParams.Hubs {
+		ip := net.ParseIP(hub.IP)
+		if hubClaimed[ip.String()] {
+			continue
+		}
+
+		slots = append(slots, peerSlot{
+			id:       nextID(),
+			ip:       IPAddress{S: ip.String(), IP: ip},
+			existing: -1,
+		})
+	}
+
+	// reserved peers that don't exist yet are created, in the order of the
+	// reservations
+	for _, r := range conf.GenerationParams.Reservations {
+		ip := net.ParseIP(strings.TrimSpace(r.IP))
+		if l := reserved[ip.String()]; l >= 0 && l != serverExisting {
+			continue
+		}
+
+		slots = append(slots, peerSlot{
+			id:       nextID(),
+			ip:       IPAddress{S: ip.String(), IP: ip},
+			existing: -1,
+			name:     conf.reservations[ip.String()],
+		})
+	}
+
+	ip := conf.network.IP
+
+	for _, l := range pending {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		ip = conf.addresses.Next(ip, used)
+		if ip == nil {
+			return nil, fmt.Errorf("cidr %v is too small to hold %v peers", conf.GenerationParams.CIDR, len(slots))
+		}
+
+		used[ip.String()] = true
+		slots[l].ip = IPAddress{S: ip.String(), IP: ip}
+	}
+
+	if conf.GenerationParams.MaxPeers > 0 && uint(len(slots)) > conf.GenerationParams.MaxPeers {
+		return nil, fmt.Errorf(
+			"configuration has %v peers, which exceeds maxPeers %v",
+			len(slots),
+			conf.GenerationParams.MaxPeers,
+		)
+	}
+
+	sort.Slice(slots, func(a, b int) bool {
+		return slots[a].id < slots[b].id
+	})
+
+	return slots, nil
+}
+
+// serverIndex returns the index of the server within conf.Peers, or -1 if
+// there is no server.
+func (conf *Configuration) serverIndex() int {
+	for i := range conf.Peers {
+		if conf.Peers[i].IsServer {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// AllocatePeer provisions a single new peer in a sparse configuration, using
+// the next free IP address in the CIDR, and regenerates the server config so
+// that it includes the new peer. The configuration must have already been
+// generated at least once so that the server exists.
+//
+// If name is empty, the name from the GenerationForm is used instead.
+func (conf *Configuration) AllocatePeer(name string) (WgConfig, error) {
+	return conf.allocatePeer(name, "")
+}
+
+// AllocateExternalPeer behaves the same as AllocatePeer, but provisions an
+// external peer that owns its private key and only shares publicKey.
+func (conf *Configuration) AllocateExternalPeer(name, publicKey string) (WgConfig, error) {
+	err := ValidatePublicKey(publicKey)
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	return conf.allocatePeer(name, publicKey)
+}
+
+// allocatePeer implements AllocatePeer. If publicKey is set, the peer is
+// external.
+func (conf *Configuration) allocatePeer(name, publicKey string) (WgConfig, error) {
+	if !conf.GenerationParams.Sparse {
+		return WgConfig{}, fmt.Errorf("peers can only be allocated when sparse is enabled")
+	}
+
+	err := conf.parseNetwork()
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	err = conf.parseTemplates()
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	serverIndex := conf.serverIndex()
+	if serverIndex < 0 {
+		return WgConfig{}, fmt.Errorf("no server found, generate the configuration first")
+	}
+
+	err = conf.parseRoutedSubnets(conf.Peers)
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	if conf.GenerationParams.MaxPeers > 0 && uint(len(conf.Peers)) >= conf.GenerationParams.MaxPeers {
+		return WgConfig{}, fmt.Errorf("cannot allocate more than maxPeers %v peers", conf.GenerationParams.MaxPeers)
+	}
+
+	used := make(map[string]bool, len(conf.Peers)+len(conf.hubs)+1)
+	used[conf.serverIP.String()] = true
+
+	for ip := range conf.hubs {
+		used[ip] = true
+	}
+
+	usedSecondary := make(map[string]bool, len(conf.Peers))
+
+	var maxID uint
+
+	hubs := []WgConfig{}
+
+	for _, p := range conf.Peers {
+		used[p.IP] = true
+		usedSecondary[p.SecondaryIP] = true
+		maxID = max(maxID, p.ID)
+
+		if p.IsHub {
+			hubs = append(hubs, p)
+		}
+	}
+
+	// reserved addresses are only used by the peers they're reserved for
+	for ip := range conf.reservations {
+		used[ip] = true
+	}
+
+	ip, ok := conf.reservedIP(name)
+	if ok {
+		for _, p := range conf.Peers {
+			switch {
+			case p.Name == name:
+				return WgConfig{}, fmt.Errorf("%v is reserved for %v, which already exists", ip, name)
+			case p.IP == ip.String():
+				return WgConfig{}, fmt.Errorf("%v is reserved for %v, but is used by peer %v, generate the configuration first", ip, name, p.ID)
+			}
+		}
+	} else {
+		ip = conf.addresses.Next(conf.network.IP, used)
+		if ip == nil {
+			return WgConfig{}, fmt.Errorf("no free addresses left in cidr %v", conf.GenerationParams.CIDR)
+		}
+	}
+
+	w := WgConfig{ID: maxID + 1, Name: name, IP: ip.String(), External: publicKey != "", PublicKey: publicKey}
+
+	// the new peer can't reuse any preshared keys left behind by a released
+	// peer that had the same ID
+	conf.loadPresharedKeys(conf.Peers, false)
+	conf.psks.rekey(w.ID)
+
+	if conf.secondaryNetwork != nil {
+		secondaryIP := conf.secondaryAddresses.Next(conf.secondaryNetwork.IP, usedSecondary)
+		if secondaryIP == nil {
+			return WgConfig{}, fmt.Errorf("no free addresses left in secondary cidr %v", conf.GenerationParams.SecondaryCIDR)
+		}
+
+		w.SecondaryIP = secondaryIP.String()
+	}
+
+	err = conf.applySoftRules(&w)
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	err = conf.applyForcedRules(&w)
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	// an explicitly requested name takes priority over forced names
+	if name != "" {
+		w.Name = name
+	}
+
+	err = conf.applyKeyRules(&w)
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	peers := append(slices.Clone(conf.Peers), w)
+
+	err = conf.validateTopology(len(peers))
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	// every member of a mesh needs a [Peer] section for the new peer
+	if conf.isMesh() {
+		err = conf.renderMesh(peers)
+		if err != nil {
+			return WgConfig{}, err
+		}
+
+		conf.Peers = peers
+		conf.PresharedKeys = conf.psks.snapshot()
+
+		return peers[len(peers)-1], nil
+	}
+
+	server := conf.Peers[serverIndex]
+
+	// the key shared with the server is kept on the peer as well
+	w.PreSharedKey = conf.pairKey(server.ID, w.ID, w.PreSharedKey)
+
+	w.Config, err = conf.renderClientConfig(w, server, hubs)
+	if err != nil {
+		return WgConfig{}, fmt.Errorf("error generating config for client %v: %w", w.ID, err)
+	}
+
+	peers[len(peers)-1] = w
+
+	err = conf.nodeConfigs(peers)
+	if err != nil {
+		return WgConfig{}, err
+	}
+
+	conf.Peers = peers
+	conf.PresharedKeys = conf.psks.snapshot()
+
+	return w, nil
+}
+
+// ReleasePeer removes the peer with the given ID from a sparse configuration,
+// freeing up its IP address, and regenerates the server config so that it no
+// longer includes the peer. The server itself cannot be released.
+func (conf *Configuration) ReleasePeer(id uint) error {
+	if !conf.GenerationParams.Sparse {
+		return fmt.Errorf("peers can only be released when sparse is enabled")
+	}
+
+	err := conf.parseNetwork()
+	if err != nil {
+		return err
+	}
+
+	err = conf.parseTemplates()
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(conf.Peers, func(w WgConfig) bool {
+		return w.ID == id
+	})
+	if index < 0 {
+		return fmt.Errorf("no peer found with id %v", id)
+	}
+
+	if conf.Peers[index].IsServer {
+		return fmt.Errorf("cannot release the server peer %v", id)
+	}
+
+	if conf.Peers[index].IsHub {
+		return fmt.Errorf("cannot release the hub peer %v, remove it from the hubs instead", id)
+	}
+
+	peers := slices.Delete(slices.Clone(conf.Peers), index, index+1)
+
+	if conf.serverIndex() < 0 {
+		return fmt.Errorf("no server found, generate the configuration first")
+	}
+
+	// the released peer's preshared keys are left out of the snapshot
+	conf.loadPresharedKeys(peers, false)
+
+	if conf.isMesh() {
+		err = conf.renderMesh(peers)
+	} else {
+		err = conf.nodeConfigs(peers)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	conf.Peers = peers
+	conf.PresharedKeys = conf.psks.snapshot()
+
+	return nil
+}
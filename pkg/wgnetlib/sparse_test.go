@@ -0,0 +1,195 @@
+package gen
+
+import (
+	"strings"
+	"testing"
+)
+
+// newSparseNetwork returns a generated sparse /29 network, which only
+// contains the server at 10.0.0.1.
+func newSparseNetwork(t *testing.T) *Configuration {
+	t.Helper()
+
+	conf := &Configuration{
+		GenerationParams: GenerationForm{
+			CIDR:         "10.0.0.0/29",
+			Server:       "10.0.0.1",
+			Endpoint:     "5.5.5.5",
+			EndpointPort: 51820,
+			Sparse:       true,
+		},
+	}
+
+	err := conf.GenerateWithOptions(GenerateOptions{})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	if len(conf.Peers) != 1 {
+		t.Fatalf("expected only the server, got %v peers", len(conf.Peers))
+	}
+
+	return conf
+}
+
+// allocate allocates a peer named name and returns its address.
+func allocate(t *testing.T, conf *Configuration, name string) WgConfig {
+	t.Helper()
+
+	w, err := conf.AllocatePeer(name)
+	if err != nil {
+		t.Fatalf("failed to allocate %v: %v", name, err)
+	}
+
+	return w
+}
+
+func TestAllocatePeer(t *testing.T) {
+	conf := newSparseNetwork(t)
+
+	a := allocate(t, conf, "a")
+	b := allocate(t, conf, "b")
+
+	if a.IP != "10.0.0.2" || b.IP != "10.0.0.3" {
+		t.Errorf("expected the first free addresses 10.0.0.2 & 10.0.0.3, got %v & %v", a.IP, b.IP)
+	}
+
+	if a.ID != 2 || b.ID != 3 {
+		t.Errorf("expected ids 2 & 3, got %v & %v", a.ID, b.ID)
+	}
+
+	if a.Config == "" || a.PublicKey == "" {
+		t.Error("allocated peer has no config or keys")
+	}
+
+	server := testPeer(t, conf, 1)
+	if !strings.Contains(server.Config, a.PublicKey) || !strings.Contains(server.Config, b.PublicKey) {
+		t.Error("server config doesn't include the allocated peers")
+	}
+}
+
+func TestAllocatePeerReusesReleasedSlot(t *testing.T) {
+	conf := newSparseNetwork(t)
+
+	a := allocate(t, conf, "a")
+	allocate(t, conf, "b")
+
+	err := conf.ReleasePeer(a.ID)
+	if err != nil {
+		t.Fatalf("failed to release peer: %v", err)
+	}
+
+	if strings.Contains(testPeer(t, conf, 1).Config, a.PublicKey) {
+		t.Error("server config still includes the released peer")
+	}
+
+	c := allocate(t, conf, "c")
+	if c.IP != a.IP {
+		t.Errorf("expected the released address %v to be reused, got %v", a.IP, c.IP)
+	}
+
+	// new peers are given the ID after the highest one, which b still has
+	if c.ID != 4 {
+		t.Errorf("expected id 4, got %v", c.ID)
+	}
+}
+
+func TestAllocatePeerReusesHighestID(t *testing.T) {
+	conf := newSparseNetwork(t)
+
+	allocate(t, conf, "a")
+	b := allocate(t, conf, "b")
+
+	err := conf.ReleasePeer(b.ID)
+	if err != nil {
+		t.Fatalf("failed to release peer: %v", err)
+	}
+
+	// leave behind every key that b had, as if they hadn't been cleaned up
+	stale := map[pairID]string{
+		newPairID(1, b.ID): b.PreSharedKey,
+		newPairID(2, b.ID): GeneratePreSharedKey(),
+	}
+
+	for id, key := range stale {
+		conf.PresharedKeys = append(conf.PresharedKeys, PresharedKey{Peers: id, Key: key})
+	}
+
+	c := allocate(t, conf, "c")
+	if c.ID != b.ID {
+		t.Fatalf("expected the released id %v to be reused, got %v", b.ID, c.ID)
+	}
+
+	if c.PreSharedKey == b.PreSharedKey {
+		t.Error("the new peer kept the released peer's preshared key")
+	}
+
+	for id, key := range pairKeys(conf) {
+		if key == stale[id] {
+			t.Errorf("pair %v kept the released peer's preshared key", id)
+		}
+	}
+}
+
+func TestAllocatePeerReservations(t *testing.T) {
+	conf := newSparseNetwork(t)
+	conf.GenerationParams.Reservations = []Reservation{{Name: "dns", IP: "10.0.0.3"}}
+
+	a := allocate(t, conf, "a")
+	b := allocate(t, conf, "b")
+
+	if a.IP != "10.0.0.2" || b.IP != "10.0.0.4" {
+		t.Errorf("expected the reserved address to be skipped, got %v & %v", a.IP, b.IP)
+	}
+
+	dns := allocate(t, conf, "dns")
+	if dns.IP != "10.0.0.3" {
+		t.Errorf("expected the reserved address 10.0.0.3, got %v", dns.IP)
+	}
+
+	_, err := conf.AllocatePeer("dns")
+	if err == nil {
+		t.Error("expected an error when allocating a reserved name twice")
+	}
+}
+
+func TestAllocatePeerExhausted(t *testing.T) {
+	conf := newSparseNetwork(t)
+
+	// a /29 has 6 usable addresses, one of which is the server
+	for range 5 {
+		allocate(t, conf, "")
+	}
+
+	peers := len(conf.Peers)
+
+	_, err := conf.AllocatePeer("")
+	if err == nil {
+		t.Fatal("expected an error when the cidr is exhausted")
+	}
+
+	if len(conf.Peers) != peers {
+		t.Errorf("expected %v peers after the failed allocation, got %v", peers, len(conf.Peers))
+	}
+}
+
+func TestReleasePeer(t *testing.T) {
+	conf := newSparseNetwork(t)
+	allocate(t, conf, "a")
+
+	tests := map[string]uint{
+		"unknown id": 99,
+		"server":     1,
+	}
+
+	for name, id := range tests {
+		err := conf.ReleasePeer(id)
+		if err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+
+	if len(conf.Peers) != 2 {
+		t.Errorf("expected 2 peers after the failed releases, got %v", len(conf.Peers))
+	}
+}
@@ -0,0 +1,317 @@
+package gen
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// sqliteSchema creates the tables used by SQLiteStore. Peers are stored with
+// a few queryable columns alongside the full peer as json, so that new fields
+// on WgConfig don't require schema changes.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS generation_form (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	data TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS peers (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	public_key TEXT NOT NULL,
+	is_server INTEGER NOT NULL,
+	config TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS preshared_keys (
+	peer_a INTEGER NOT NULL,
+	peer_b INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	PRIMARY KEY (peer_a, peer_b)
+);
+`
+
+// SQLiteStore is a Store backed by a SQLite database. The library does not
+// depend on any particular SQLite driver, so the caller is responsible for
+// importing one (such as modernc.org/sqlite or github.com/mattn/go-sqlite3)
+// and opening the database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore creates the required tables in db if they don't already
+// exist, and returns a Store that uses db.
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	_, err := db.Exec(sqliteSchema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sqlite schema: %w", err)
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) LoadForm() (GenerationForm, bool, error) {
+	var form GenerationForm
+
+	var data string
+
+	err := s.db.QueryRow(`SELECT data FROM generation_form WHERE id = 1`).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return form, false, nil
+	}
+
+	if err != nil {
+		return form, false, fmt.Errorf("failed to query generation form: %w", err)
+	}
+
+	err = json.Unmarshal([]byte(data), &form)
+	if err != nil {
+		return form, false, fmt.Errorf("failed to unmarshal generation form: %w", err)
+	}
+
+	return form, true, nil
+}
+
+func (s *SQLiteStore) SaveForm(form GenerationForm) error {
+	return s.inTx(func(tx *sqliteTx) error {
+		return tx.SaveForm(form)
+	})
+}
+
+func (s *SQLiteStore) Peers() ([]WgConfig, error) {
+	rows, err := s.db.Query(`SELECT data FROM peers ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query peers: %w", err)
+	}
+	defer rows.Close()
+
+	peers := []WgConfig{}
+
+	for rows.Next() {
+		var data string
+
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan peer: %w", err)
+		}
+
+		var w WgConfig
+
+		err = json.Unmarshal([]byte(data), &w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal peer: %w", err)
+		}
+
+		peers = append(peers, w)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query peers: %w", err)
+	}
+
+	return peers, nil
+}
+
+func (s *SQLiteStore) Peer(id uint) (WgConfig, bool, error) {
+	var w WgConfig
+
+	var data, config string
+
+	err := s.db.QueryRow(`SELECT data, config FROM peers WHERE id = ?`, id).Scan(&data, &config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return w, false, nil
+	}
+
+	if err != nil {
+		return w, false, fmt.Errorf("failed to query peer %v: %w", id, err)
+	}
+
+	err = json.Unmarshal([]byte(data), &w)
+	if err != nil {
+		return w, false, fmt.Errorf("failed to unmarshal peer %v: %w", id, err)
+	}
+
+	w.Config = config
+
+	return w, true, nil
+}
+
+func (s *SQLiteStore) PutPeers(peers []WgConfig) error {
+	return s.inTx(func(tx *sqliteTx) error {
+		return tx.PutPeers(peers)
+	})
+}
+
+func (s *SQLiteStore) DeletePeers(ids []uint) error {
+	return s.inTx(func(tx *sqliteTx) error {
+		return tx.DeletePeers(ids)
+	})
+}
+
+func (s *SQLiteStore) PresharedKeys() ([]PresharedKey, error) {
+	rows, err := s.db.Query(`SELECT peer_a, peer_b, key FROM preshared_keys ORDER BY peer_a, peer_b`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preshared keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []PresharedKey{}
+
+	for rows.Next() {
+		var k PresharedKey
+
+		err = rows.Scan(&k.Peers[0], &k.Peers[1], &k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan preshared key: %w", err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query preshared keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (s *SQLiteStore) SetPresharedKeys(keys []PresharedKey) error {
+	return s.inTx(func(tx *sqliteTx) error {
+		return tx.SetPresharedKeys(keys)
+	})
+}
+
+func (s *SQLiteStore) Begin() (StoreTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	return &sqliteTx{tx: tx}, nil
+}
+
+// inTx runs fn within its own transaction, which is committed if fn succeeds
+// and rolled back otherwise.
+func (s *SQLiteStore) inTx(fn func(tx *sqliteTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	err = fn(&sqliteTx{tx: tx})
+	if err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteTx is a StoreTx started by SQLiteStore.Begin.
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+func (t *sqliteTx) Commit() error {
+	err := t.tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (t *sqliteTx) Rollback() error {
+	err := t.tx.Rollback()
+	if err != nil {
+		return fmt.Errorf("failed to roll back transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (t *sqliteTx) SaveForm(form GenerationForm) error {
+	data, err := json.Marshal(form)
+	if err != nil {
+		return fmt.Errorf("failed to marshal generation form: %w", err)
+	}
+
+	_, err = t.tx.Exec(`INSERT OR REPLACE INTO generation_form (id, data) VALUES (1, ?)`, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to save generation form: %w", err)
+	}
+
+	return nil
+}
+
+func (t *sqliteTx) PutPeers(peers []WgConfig) error {
+	stmt, err := t.tx.Prepare(`INSERT OR REPLACE INTO peers
+		(id, name, ip, public_key, is_server, config, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, w := range peers {
+		// the config is stored in its own column, so don't store it twice
+		config := w.Config
+		w.Config = ""
+
+		data, err := json.Marshal(w)
+		if err != nil {
+			return fmt.Errorf("failed to marshal peer %v: %w", w.ID, err)
+		}
+
+		_, err = stmt.Exec(w.ID, w.Name, w.IP, w.PublicKey, w.IsServer, config, string(data))
+		if err != nil {
+			return fmt.Errorf("failed to save peer %v: %w", w.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *sqliteTx) DeletePeers(ids []uint) error {
+	for _, id := range ids {
+		_, err := t.tx.Exec(`DELETE FROM peers WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete peer %v: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *sqliteTx) SetPresharedKeys(keys []PresharedKey) error {
+	_, err := t.tx.Exec(`DELETE FROM preshared_keys`)
+	if err != nil {
+		return fmt.Errorf("failed to delete preshared keys: %w", err)
+	}
+
+	stmt, err := t.tx.Prepare(`INSERT INTO preshared_keys (peer_a, peer_b, key) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, k := range keys {
+		_, err = stmt.Exec(k.Peers[0], k.Peers[1], k.Key)
+		if err != nil {
+			return fmt.Errorf("failed to save preshared key for %v & %v: %w", k.Peers[0], k.Peers[1], err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package gen
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Store persists a configuration's GenerationForm and peers, keyed by peer
+// ID, so that individual peers can be read and updated without loading and
+// saving the entire configuration.
+type Store interface {
+	// LoadForm returns the stored GenerationForm. ok is false if no form has
+	// been saved yet.
+	LoadForm() (form GenerationForm, ok bool, err error)
+	// Peers returns every stored peer ordered by ID. The Config field of each
+	// peer is left empty, since it's regenerated from the other fields anyway;
+	// use Peer to retrieve a peer's config.
+	Peers() ([]WgConfig, error)
+	// Peer returns a single stored peer, including its config. ok is false if
+	// no peer exists with the given ID.
+	Peer(id uint) (w WgConfig, ok bool, err error)
+	// PresharedKeys returns the preshared key of every stored pair of peers.
+	PresharedKeys() ([]PresharedKey, error)
+	// Each of the StoreWriter methods is applied on its own.
+	StoreWriter
+	// Begin starts a transaction, so that several writes are either all
+	// applied by Commit or all discarded by Rollback. The Store must not be
+	// written to directly until the transaction has finished.
+	Begin() (StoreTx, error)
+}
+
+// StoreWriter holds the methods that modify a Store.
+type StoreWriter interface {
+	// SaveForm replaces the stored GenerationForm.
+	SaveForm(form GenerationForm) error
+	// PutPeers inserts or replaces each of the given peers, keyed by ID.
+	PutPeers(peers []WgConfig) error
+	// DeletePeers deletes the peers with the given IDs.
+	DeletePeers(ids []uint) error
+	// SetPresharedKeys replaces every stored preshared key.
+	SetPresharedKeys(keys []PresharedKey) error
+}
+
+// StoreTx is a transaction started by Store.Begin. Once Commit or Rollback
+// has been called, the transaction can't be used anymore.
+type StoreTx interface {
+	StoreWriter
+	// Commit applies every write made within the transaction.
+	Commit() error
+	// Rollback discards every write made within the transaction.
+	Rollback() error
+}
+
+// storeBatchSize is the number of peers that are written to a Store at once
+// while generating.
+const storeBatchSize = 1000
+
+// storeSink writes generated peers to a store transaction in batches, keeping
+// track of which peers were written so that stale peers can be deleted
+// afterwards.
+type storeSink struct {
+	store     StoreWriter
+	batch     []WgConfig
+	batchSize int
+	written   map[uint]bool
+}
+
+func newStoreSink(store StoreWriter, batchSize int) *storeSink {
+	return &storeSink{
+		store:     store,
+		batch:     make([]WgConfig, 0, batchSize),
+		batchSize: batchSize,
+		written:   make(map[uint]bool),
+	}
+}
+
+func (s *storeSink) Write(w WgConfig) error {
+	s.batch = append(s.batch, w)
+	s.written[w.ID] = true
+
+	if len(s.batch) >= s.batchSize {
+		return s.flush()
+	}
+
+	return nil
+}
+
+func (s *storeSink) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	err := s.store.PutPeers(s.batch)
+	if err != nil {
+		return fmt.Errorf("failed to store peers: %w", err)
+	}
+
+	s.batch = s.batch[:0]
+
+	return nil
+}
+
+// generateToStore reads the existing peers from store, generates the
+// configuration, and writes the resulting peers and the GenerationForm back to
+// store. Peers that no longer exist after generating are deleted. Everything is
+// written within a single transaction, so if generating fails the store is
+// left untouched.
+func (conf *Configuration) generateToStore(ctx context.Context, opts GenerateOptions) (err error) {
+	store := opts.Store
+
+	existing, err := store.Peers()
+	if err != nil {
+		return fmt.Errorf("failed to load peers from store: %w", err)
+	}
+
+	keys, err := store.PresharedKeys()
+	if err != nil {
+		return fmt.Errorf("failed to load preshared keys from store: %w", err)
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin store transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	sink := newStoreSink(tx, storeBatchSize)
+
+	// conf.Peers & conf.PresharedKeys are only used as the input for this run
+	peers, presharedKeys := conf.Peers, conf.PresharedKeys
+	conf.Peers, conf.PresharedKeys = existing, keys
+
+	defer func() {
+		conf.Peers, conf.PresharedKeys = peers, presharedKeys
+	}()
+
+	opts.Store = nil
+	opts.Sink = sink
+
+	err = conf.GenerateContext(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	err = sink.flush()
+	if err != nil {
+		return err
+	}
+
+	stale := []uint{}
+
+	for _, w := range existing {
+		if !sink.written[w.ID] {
+			stale = append(stale, w.ID)
+		}
+	}
+
+	sort.Slice(stale, func(a, b int) bool {
+		return stale[a] < stale[b]
+	})
+
+	err = tx.DeletePeers(stale)
+	if err != nil {
+		return fmt.Errorf("failed to delete stale peers from store: %w", err)
+	}
+
+	err = tx.SetPresharedKeys(conf.PresharedKeys)
+	if err != nil {
+		return fmt.Errorf("failed to save preshared keys to store: %w", err)
+	}
+
+	err = tx.SaveForm(conf.GenerationParams)
+	if err != nil {
+		return fmt.Errorf("failed to save generation form to store: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit store transaction: %w", err)
+	}
+
+	return nil
+}
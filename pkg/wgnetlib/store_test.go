@@ -0,0 +1,130 @@
+package gen
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestStore returns a SQLiteStore backed by a new database file.
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "network.sqlite"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	return store
+}
+
+// storeContents is everything that a Store holds.
+type storeContents struct {
+	form  GenerationForm
+	peers []WgConfig
+	keys  []PresharedKey
+}
+
+func readStore(t *testing.T, store Store) storeContents {
+	t.Helper()
+
+	form, _, err := store.LoadForm()
+	if err != nil {
+		t.Fatalf("failed to load form: %v", err)
+	}
+
+	peers, err := store.Peers()
+	if err != nil {
+		t.Fatalf("failed to load peers: %v", err)
+	}
+
+	keys, err := store.PresharedKeys()
+	if err != nil {
+		t.Fatalf("failed to load preshared keys: %v", err)
+	}
+
+	return storeContents{form: form, peers: peers, keys: keys}
+}
+
+// cancelAfter cancels a context once a number of peers have been
+// post-processed.
+type cancelAfter struct {
+	NopProgressReporter
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Increment(phase Phase) {
+	if phase != PhasePostProcessing {
+		return
+	}
+
+	c.n--
+	if c.n == 0 {
+		c.cancel()
+	}
+}
+
+func TestGenerateToStoreCancelled(t *testing.T) {
+	store := newTestStore(t)
+
+	// large enough for several batches to be written before cancelling
+	conf := &Configuration{
+		GenerationParams: GenerationForm{
+			CIDR:         "10.0.0.0/20",
+			Server:       "10.0.0.1",
+			Endpoint:     "5.5.5.5",
+			EndpointPort: 51820,
+		},
+	}
+
+	err := conf.GenerateWithOptions(GenerateOptions{Store: store})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	before := readStore(t, store)
+	if len(before.peers) != 4094 || len(before.keys) != 4093 {
+		t.Fatalf("expected 4094 peers & 4093 preshared keys, got %v & %v", len(before.peers), len(before.keys))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf.GenerationParams.RegenerateKeys = true
+	conf.GenerationParams.Name = "renamed"
+
+	err = conf.GenerateContext(ctx, GenerateOptions{
+		Store:    store,
+		Progress: &cancelAfter{n: 2*storeBatchSize + 1, cancel: cancel},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	after := readStore(t, store)
+
+	if !reflect.DeepEqual(before.form, after.form) {
+		t.Error("the generation form was changed by a cancelled run")
+	}
+
+	if !reflect.DeepEqual(before.peers, after.peers) {
+		t.Error("the peers were changed by a cancelled run")
+	}
+
+	if !reflect.DeepEqual(before.keys, after.keys) {
+		t.Error("the preshared keys were changed by a cancelled run")
+	}
+}